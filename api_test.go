@@ -0,0 +1,405 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+// Running a request through the full router of a server backed by the
+// in-memory store and decoding the JSON response into out.
+func doRequest(t *testing.T, router http.Handler, method, path, token string, body any, out any) *httptest.ResponseRecorder {
+    var buf bytes.Buffer
+    if body != nil {
+        assert.Nil(t, json.NewEncoder(&buf).Encode(body))
+    }
+    req := httptest.NewRequest(method, path, &buf)
+    if token != "" {
+        req.Header.Set("x-jwt-token", token)
+    }
+    rr := httptest.NewRecorder()
+    router.ServeHTTP(rr, req)
+    if out != nil {
+        assert.Nil(t, json.NewDecoder(rr.Body).Decode(out))
+    }
+    return rr
+}
+
+func newTestServer() (*APIServer, *MemoryStore, http.Handler) {
+    store := NewMemoryStore()
+    keys, err := NewEphemeralKeyring()
+    if err != nil {
+        panic(err)
+    }
+    server := NewAPIServer(":0", store, keys)
+    return server, store, server.Router()
+}
+
+// Logging in without going through POST /login, which needs a password
+func loginAs(t *testing.T, server *APIServer, acc *Account) *LoginResponse {
+    resp, err := server.startSession(ctx, acc)
+    assert.Nil(t, err)
+    return resp
+}
+
+func TestWriteErrorHidesInternalErrors(t *testing.T){
+    r := httptest.NewRequest("GET", "/", nil)
+
+    rr := httptest.NewRecorder()
+    writeError(rr, r, errors.New("pq: connection refused"))
+    assert.Equal(t, http.StatusInternalServerError, rr.Code)
+    assert.NotContains(t, rr.Body.String(), "pq:")
+
+    rr = httptest.NewRecorder()
+    writeError(rr, r, errAccountNotFound(7))
+    apiErr := new(APIError)
+    assert.Nil(t, json.NewDecoder(rr.Body).Decode(apiErr))
+    assert.Equal(t, http.StatusNotFound, rr.Code)
+    assert.Equal(t, "account_not_found", apiErr.Code)
+    assert.Equal(t, "account 7 not found", apiErr.Message)
+    assert.ErrorIs(t, errAccountNotFound(7), ErrAccountNotFound)
+}
+
+func TestTransferStatusCodes(t *testing.T){
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    to := newTestAccount(t, store, 222222, 0)
+    token := loginAs(t, server, from).Token
+
+    transfer := new(Transfer)
+    rr := doRequest(t, router, "POST", "/transfer", token, TransferRequest{ToAccount: int(to.Number), Amount: 40}, transfer)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Equal(t, int64(60), transfer.FromBalance)
+
+    apiErr := new(APIError)
+    rr = doRequest(t, router, "POST", "/transfer", token, TransferRequest{ToAccount: int(to.Number), Amount: 1000}, apiErr)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    assert.Equal(t, "insufficient_funds", apiErr.Code)
+
+    rr = doRequest(t, router, "GET", "/transfer", token, nil, apiErr)
+    assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+    rr = doRequest(t, router, "POST", "/transfer", "", TransferRequest{}, apiErr)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+    // Someone else's account
+    rr = doRequest(t, router, "GET", "/account/2", token, nil, apiErr)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestRefreshTokenRotationAndLogout(t *testing.T){
+    server, store, router := newTestServer()
+    acc := newTestAccount(t, store, 111111, 0)
+    login := loginAs(t, server, acc)
+
+    // Every refresh hands out a new refresh token
+    refreshed := new(LoginResponse)
+    rr := doRequest(t, router, "POST", "/token/refresh", "", RefreshRequest{login.RefreshToken}, refreshed)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+
+    rr = doRequest(t, router, "GET", "/account/1", refreshed.Token, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+
+    // Using the old one again revokes the session, which also takes out the
+    // refresh token and access token that were issued with it
+    apiErr := new(APIError)
+    rr = doRequest(t, router, "POST", "/token/refresh", "", RefreshRequest{login.RefreshToken}, apiErr)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    assert.Equal(t, "refresh_token_reused", apiErr.Code)
+
+    rr = doRequest(t, router, "POST", "/token/refresh", "", RefreshRequest{refreshed.RefreshToken}, apiErr)
+    assert.Equal(t, "invalid_refresh_token", apiErr.Code)
+    rr = doRequest(t, router, "GET", "/account/1", refreshed.Token, nil, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+    // Logging out kills the access token right away
+    login = loginAs(t, server, acc)
+    rr = doRequest(t, router, "POST", "/logout", login.Token, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    rr = doRequest(t, router, "GET", "/account/1", login.Token, nil, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestExpiredAccessToken(t *testing.T){
+    server, store, router := newTestServer()
+    acc := newTestAccount(t, store, 111111, 0)
+    login := loginAs(t, server, acc)
+
+    claims, _ := server.keys.Parse(login.Token)
+    sid := claims.Claims.(*Claims).SessionID
+    past := time.Now().Add(-time.Hour)
+    token, err := createJWT(server.keys, acc, sid, past, past.Add(time.Minute))
+    assert.Nil(t, err)
+
+    rr := doRequest(t, router, "GET", "/account/1", token, nil, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestRolePolicies(t *testing.T){
+    server, store, router := newTestServer()
+    customer := newTestAccount(t, store, 111111, 100)
+    other := newTestAccount(t, store, 222222, 0)
+    teller := newTestAccount(t, store, 333333, 0)
+    admin := newTestAccount(t, store, 444444, 0)
+    store.UpdateAccountRole(ctx, teller.ID, RoleTeller)
+    store.UpdateAccountRole(ctx, admin.ID, RoleAdmin)
+    teller.Role, admin.Role = RoleTeller, RoleAdmin
+
+    customerToken := loginAs(t, server, customer).Token
+    tellerToken := loginAs(t, server, teller).Token
+    adminToken := loginAs(t, server, admin).Token
+
+    // Listing accounts is for staff only
+    rr := doRequest(t, router, "GET", "/account", customerToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "GET", "/account", "", nil, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    rr = doRequest(t, router, "GET", "/account", tellerToken, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+
+    // Customers only see their own account, staff see all of them
+    rr = doRequest(t, router, "GET", "/account/2", customerToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "GET", "/account/1", customerToken, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    rr = doRequest(t, router, "GET", "/account/1/transactions", tellerToken, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+
+    // Customers cannot delete accounts, not even their own
+    rr = doRequest(t, router, "DELETE", "/account/1", customerToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "DELETE", "/account/2", tellerToken, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    _, err := store.GetAccountByID(ctx, other.ID)
+    assert.ErrorIs(t, err, ErrAccountNotFound)
+
+    // Tellers can only delete customers, and nobody can delete themselves
+    rr = doRequest(t, router, "DELETE", "/account/4", tellerToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "DELETE", "/account/3", tellerToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "DELETE", "/account/4", adminToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    _, err = store.GetAccountByID(ctx, admin.ID)
+    assert.Nil(t, err)
+
+    // Only admins hand out roles, and promoting someone logs them out of 
+    // their old role
+    rr = doRequest(t, router, "PUT", "/account/1/role", tellerToken, UpdateRoleRequest{RoleTeller}, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "PUT", "/account/1/role", adminToken, UpdateRoleRequest{"boss"}, nil)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    rr = doRequest(t, router, "PUT", "/account/1/role", adminToken, UpdateRoleRequest{RoleTeller}, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    rr = doRequest(t, router, "GET", "/account/1", customerToken, nil, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+    rr = doRequest(t, router, "PATCH", "/account/1", adminToken, nil, nil)
+    assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
+
+func TestCashMovements(t *testing.T){
+    server, store, router := newTestServer()
+    customer := newTestAccount(t, store, 111111, 0)
+    teller := newTestAccount(t, store, 222222, 0)
+    store.UpdateAccountRole(ctx, teller.ID, RoleTeller)
+    teller.Role = RoleTeller
+    tellerToken := loginAs(t, server, teller).Token
+
+    entry := new(JournalEntry)
+    rr := doRequest(t, router, "POST", fmt.Sprintf("/account/%d/deposit", customer.ID), tellerToken, CashRequest{Amount: 50}, entry)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    page, err := store.GetAuditRecords(ctx, &AuditQuery{Action: AuditDeposit, Limit: 10})
+    assert.Nil(t, err)
+    if assert.Len(t, page.Records, 1) {
+        assert.Equal(t, customer.Number, *page.Records[0].TargetNumber)
+    }
+
+    // Staff cannot book cash into their own account
+    rr = doRequest(t, router, "POST", fmt.Sprintf("/account/%d/deposit", teller.ID), tellerToken, CashRequest{Amount: 50}, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "POST", fmt.Sprintf("/account/%d/withdraw", teller.ID), tellerToken, CashRequest{Amount: 50}, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+
+    // An unknown account is turned away before anything is booked
+    rr = doRequest(t, router, "POST", "/account/99/deposit", tellerToken, CashRequest{Amount: 50}, nil)
+    assert.Equal(t, http.StatusNotFound, rr.Code)
+
+    acc, _ := store.GetAccountByID(ctx, teller.ID)
+    assert.Equal(t, int64(0), acc.Balance)
+    report, err := store.CheckLedger(ctx)
+    assert.Nil(t, err)
+    assert.True(t, report.Balanced())
+    assert.Equal(t, int64(1), report.Entries)
+}
+
+// An oversized body is refused as a whole, not fingerprinted by its start
+func TestIdempotencyOversizedBody(t *testing.T){
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    newTestAccount(t, store, 222222, 0)
+    token := loginAs(t, server, from).Token
+
+    send := func(body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("POST", "/transfer", strings.NewReader(body))
+        req.Header.Set("x-jwt-token", token)
+        req.Header.Set(idempotencyHeader, "key-1")
+        rr := httptest.NewRecorder()
+        router.ServeHTTP(rr, req)
+        return rr
+    }
+    rr := send(`{"to_account": 222222, "amount": 10}` + strings.Repeat(" ", maxBodyBytes))
+    assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+    // The key was not used up by it
+    rr = send(`{"to_account": 222222, "amount": 10}`)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Empty(t, rr.Header().Get(idempotencyReplayedHeader))
+}
+
+// A request that is running when the server gets told to stop still gets its
+// response, new connections are refused.
+func TestServeDrainsRequests(t *testing.T){
+    server, _, _ := newTestServer()
+    started := make(chan struct{})
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        close(started)
+        time.Sleep(200 * time.Millisecond)
+        w.WriteHeader(http.StatusOK)
+    })
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    assert.Nil(t, err)
+    url := "http://" + ln.Addr().String()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    served := make(chan error, 1)
+    go func() {
+        served <- server.serve(ctx, ln, handler)
+    }()
+
+    status := make(chan int, 1)
+    go func() {
+        resp, err := http.Get(url)
+        if err != nil {
+            status <- 0
+            return
+        }
+        resp.Body.Close()
+        status <- resp.StatusCode
+    }()
+    <-started
+    cancel()
+
+    assert.Equal(t, http.StatusOK, <-status)
+    assert.Nil(t, <-served)
+    _, err = http.Get(url)
+    assert.NotNil(t, err)
+}
+
+func TestServeShutdownTimeout(t *testing.T){
+    server, _, _ := newTestServer()
+    server.serverConfig.ShutdownTimeout = Duration(50 * time.Millisecond)
+    started := make(chan struct{})
+    release := make(chan struct{})
+    defer close(release)
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        close(started)
+        <-release
+    })
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    assert.Nil(t, err)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    served := make(chan error, 1)
+    go func() {
+        served <- server.serve(ctx, ln, handler)
+    }()
+    go http.Get("http://" + ln.Addr().String())
+    <-started
+    cancel()
+    assert.ErrorIs(t, <-served, context.DeadlineExceeded)
+}
+
+// A store whose client hangs up while the account is being looked up, and
+// which refuses writes with a cancelled context like the database would
+type hangUpStore struct {
+    *MemoryStore
+    cancel    context.CancelFunc
+    lookupErr error
+}
+
+func (s *hangUpStore) GetAccountByNumber(ctx context.Context, number int) (*Account, error) {
+    s.cancel()
+    s.lookupErr = ctx.Err()
+    return s.MemoryStore.GetAccountByNumber(ctx, number)
+}
+
+func (s *hangUpStore) RecordLoginFailure(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (*LoginThrottle, bool, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, false, err
+    }
+    return s.MemoryStore.RecordLoginFailure(ctx, key, policy, now)
+}
+
+func (s *hangUpStore) AppendAudit(ctx context.Context, rec *AuditRecord) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return s.MemoryStore.AppendAudit(ctx, rec)
+}
+
+func TestClientHangUp(t *testing.T){
+    store := &hangUpStore{MemoryStore: NewMemoryStore()}
+    newTestAccount(t, store, 123456, 0)
+    keys, _ := NewEphemeralKeyring()
+    router := NewAPIServer(":0", store, keys).Router()
+
+    reqCtx, cancel := context.WithCancel(context.Background())
+    store.cancel = cancel
+    body := bytes.NewBufferString(`{"number": 123456, "password": "wrong"}`)
+    req := httptest.NewRequest("POST", "/login", body).WithContext(reqCtx)
+    router.ServeHTTP(httptest.NewRecorder(), req)
+
+    // The store got the context of the request
+    assert.ErrorIs(t, store.lookupErr, context.Canceled)
+    // but hanging up does not get the wrong password off the books
+    th, err := store.GetLoginThrottle(ctx, throttleKey(LockoutScopeAccount, "123456"))
+    assert.Nil(t, err)
+    assert.Equal(t, 1, th.Failures)
+    page, err := store.GetAuditRecords(ctx, &AuditQuery{Action: AuditLoginFailed, Limit: 10})
+    assert.Nil(t, err)
+    assert.Len(t, page.Records, 1)
+}
+
+// A store whose queries run into their deadline
+type slowStore struct {
+    *MemoryStore
+}
+
+func (s slowStore) GetTransactions(ctx context.Context, accountID int, q *TransactionQuery) (*TransactionPage, error) {
+    return nil, fmt.Errorf("listing transactions: %w", context.DeadlineExceeded)
+}
+
+func TestQueryTimeout(t *testing.T){
+    store := slowStore{NewMemoryStore()}
+    acc := newTestAccount(t, store, 123456, 0)
+    keys, _ := NewEphemeralKeyring()
+    server := NewAPIServer(":0", store, keys)
+    token := loginAs(t, server, acc).Token
+
+    apiErr := new(APIError)
+    rr := doRequest(t, server.Router(), "GET", "/account/1/transactions", token, nil, apiErr)
+    assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+    assert.Equal(t, ErrTimeout.Code, apiErr.Code)
+}
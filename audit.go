@@ -0,0 +1,336 @@
+package main
+
+import (
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// -- AUDIT LOG
+// Every security and money event gets an audit record: who did it (actor),
+// what they did (action), to which account (target), as part of which
+// request and from which IP, and what the affected data looked like before
+// and after. Records are only ever appended, PostgreSQL refuses to update or
+// delete them (see migrations/0010_create_audit_log.up.sql).
+//
+// Records are written by the handlers after the fact. Failing to write one
+// is logged but does not fail the request, by then the money has moved and
+// telling the client otherwise would be a lie.
+
+const (
+    AuditLoginSucceeded         = "login.succeeded"
+    AuditLoginChallenged        = "login.challenged"
+    AuditLoginFailed            = "login.failed"
+    AuditLoginLocked            = "login.locked"
+    AuditLogout                 = "logout"
+    AuditAccountCreated         = "account.created"
+    AuditAccountDeleted         = "account.deleted"
+    AuditRoleChanged            = "account.role_changed"
+    AuditAccountUnlocked        = "account.unlocked"
+    AuditPasswordChanged        = "password.changed"
+    AuditPasswordResetRequested = "password.reset_requested"
+    AuditPasswordReset          = "password.reset"
+    AuditTOTPEnabled            = "totp.enabled"
+    AuditTOTPDisabled           = "totp.disabled"
+    AuditTransfer               = "transfer"
+    AuditDeposit                = "deposit"
+    AuditWithdrawal             = "withdrawal"
+    AuditExported               = "audit.exported"
+)
+
+const (
+    defaultAuditLimit = 50
+    maxAuditLimit     = 200
+    // Page size used while streaming an export
+    auditExportBatch = 500
+)
+
+type AuditRecord struct {
+    ID     int64  `json:"id"`
+    Action string `json:"action"`
+    // Left out for events without a logged in caller (e.g. signing up)
+    ActorNumber *int64 `json:"actor_number,omitempty"`
+    ActorRole   string `json:"actor_role,omitempty"`
+    // The account number the event was about, which may not exist (failed
+    // logins) or not exist anymore (deletions).
+    TargetNumber *int64          `json:"target_number,omitempty"`
+    RequestID    string          `json:"request_id"`
+    IP           string          `json:"ip"`
+    Before       json.RawMessage `json:"before,omitempty"`
+    After        json.RawMessage `json:"after,omitempty"`
+    CreatedAt    time.Time       `json:"created_at"`
+    // Link in the hash chain of the audit log, see chain.go
+    Hash string `json:"hash,omitempty"`
+}
+
+type AuditPage struct {
+    Records    []*AuditRecord `json:"records"`
+    NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// Filters for GET /audit, zero values mean "no filter". From is inclusive
+// and To is exclusive. Records come newest first, After is the cursor.
+type AuditQuery struct {
+    After     int64
+    Limit     int
+    Action    string
+    Actor     int64
+    Target    int64
+    RequestID string
+    From      time.Time
+    To        time.Time
+}
+
+func (q *AuditQuery) Matches(rec *AuditRecord) bool {
+    if q.Action != "" && rec.Action != q.Action {
+        return false
+    }
+    if q.Actor != 0 && (rec.ActorNumber == nil || *rec.ActorNumber != q.Actor) {
+        return false
+    }
+    if q.Target != 0 && (rec.TargetNumber == nil || *rec.TargetNumber != q.Target) {
+        return false
+    }
+    if q.RequestID != "" && rec.RequestID != q.RequestID {
+        return false
+    }
+    if !q.From.IsZero() && rec.CreatedAt.Before(q.From) {
+        return false
+    }
+    if !q.To.IsZero() && !rec.CreatedAt.Before(q.To) {
+        return false
+    }
+    return true
+}
+
+// Same trick as newTransactionPage: the stores fetch one record more than
+// asked for.
+func newAuditPage(records []*AuditRecord, limit int) *AuditPage {
+    page := &AuditPage{Records: records}
+    if len(records) > limit {
+        page.Records = records[:limit]
+        page.NextCursor = encodeCursor(records[limit-1].ID)
+    }
+    return page
+}
+
+// Turning the query string of GET /audit (and /audit/export) into a query.
+// Every parameter is optional:
+// cursor, limit, action, actor, target (account numbers), request_id,
+// from, to (RFC 3339)
+func parseAuditQuery(r *http.Request) (*AuditQuery, error) {
+    params := r.URL.Query()
+    q := &AuditQuery{
+        Limit: defaultAuditLimit,
+        Action: params.Get("action"),
+        RequestID: params.Get("request_id"),
+    }
+    if v := params.Get("cursor"); v != "" {
+        after, err := decodeCursor(v)
+        if err != nil {
+            return nil, err
+        }
+        q.After = after
+    }
+    if v := params.Get("limit"); v != "" {
+        limit, err := strconv.Atoi(v)
+        if err != nil || limit <= 0 || limit > maxAuditLimit {
+            return nil, errBadRequest("limit must be between 1 and %d", maxAuditLimit)
+        }
+        q.Limit = limit
+    }
+    for name, dst := range map[string]*int64{"actor": &q.Actor, "target": &q.Target} {
+        v := params.Get(name)
+        if v == "" {
+            continue
+        }
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n <= 0 {
+            return nil, errBadRequest("%s must be an account number", name)
+        }
+        *dst = n
+    }
+    for name, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+        v := params.Get(name)
+        if v == "" {
+            continue
+        }
+        ts, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            return nil, errBadRequest("%s must be an RFC 3339 timestamp", name)
+        }
+        *dst = ts.UTC()
+    }
+    if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+        return nil, errBadRequest("from must be before to")
+    }
+    return q, nil
+}
+
+// What a handler knows about an event. The actor defaults to the logged in
+// account, a zero Target means that the event is not about any account.
+type auditEvent struct {
+    Action string
+    Actor  *Account
+    Target int64
+    Before any
+    After  any
+}
+
+func (s *APIServer) audit(r *http.Request, e auditEvent) {
+    // Whatever happened has happened, the record gets written even if the
+    // client has hung up in the meantime.
+    ctx := context.WithoutCancel(r.Context())
+    rec := &AuditRecord{
+        Action: e.Action,
+        RequestID: requestID(r),
+        IP: clientIP(r),
+        CreatedAt: time.Now().UTC(),
+    }
+    actor := e.Actor
+    if actor == nil {
+        actor, _ = authAccount(r)
+    }
+    if actor != nil {
+        number := actor.Number
+        rec.ActorNumber = &number
+        rec.ActorRole = actor.Role
+    }
+    if e.Target != 0 {
+        target := e.Target
+        rec.TargetNumber = &target
+    }
+    var err error
+    if rec.Before, err = auditValue(e.Before); err == nil {
+        if rec.After, err = auditValue(e.After); err == nil {
+            err = s.store.AppendAudit(ctx, rec)
+        }
+    }
+    if err != nil {
+        loggerFrom(ctx).Error("writing audit record failed", "action", e.Action, "error", err)
+    }
+}
+
+func auditValue(v any) (json.RawMessage, error) {
+    if v == nil {
+        return nil, nil
+    }
+    return json.Marshal(v)
+}
+
+// GET /audit
+func (s *APIServer) handleGetAudit(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    q, err := parseAuditQuery(r)
+    if err != nil {
+        return err
+    }
+    page, err := s.store.GetAuditRecords(ctx, q)
+    if err != nil {
+        return err
+    }
+    return WriteJSON(w, http.StatusOK, page)
+}
+
+// GET /audit/export?format=jsonl|csv
+// Every record matching the filters (cursor and limit are ignored) as a
+// download for compliance reviews. Exporting is an audited event itself.
+func (s *APIServer) handleExportAudit(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    q, err := parseAuditQuery(r)
+    if err != nil {
+        return err
+    }
+    format := r.URL.Query().Get("format")
+    switch format {
+    case "":
+        format = "jsonl"
+    case "jsonl", "csv":
+    default:
+        return errBadRequest("format must be either jsonl or csv")
+    }
+    q.After = 0
+    q.Limit = auditExportBatch
+
+    // The first page is fetched before anything is written, so that a broken
+    // database still gets a proper error response.
+    page, err := s.store.GetAuditRecords(ctx, q)
+    if err != nil {
+        return err
+    }
+    s.audit(r, auditEvent{Action: AuditExported, After: map[string]string{
+        "format": format,
+        "query": r.URL.RawQuery,
+    }})
+
+    filename := "audit-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+    w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+    var write func(*AuditRecord) error
+    var flush func() error
+    if format == "csv" {
+        w.Header().Set("Content-Type", "text/csv")
+        cw := csv.NewWriter(w)
+        cw.Write([]string{"id", "created_at", "action", "actor_number", "actor_role",
+            "target_number", "request_id", "ip", "before", "after", "hash"})
+        write = func(rec *AuditRecord) error {
+            return cw.Write([]string{
+                strconv.FormatInt(rec.ID, 10),
+                rec.CreatedAt.Format(time.RFC3339Nano),
+                rec.Action,
+                formatOptionalNumber(rec.ActorNumber),
+                rec.ActorRole,
+                formatOptionalNumber(rec.TargetNumber),
+                rec.RequestID,
+                rec.IP,
+                string(rec.Before),
+                string(rec.After),
+                rec.Hash,
+            })
+        }
+        flush = func() error {
+            cw.Flush()
+            return cw.Error()
+        }
+    } else {
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        enc := json.NewEncoder(w)
+        write = func(rec *AuditRecord) error {
+            return enc.Encode(rec)
+        }
+        flush = func() error { return nil }
+    }
+    w.WriteHeader(http.StatusOK)
+
+    // Once the status is out there is no way to report an error to the
+    // client anymore, a cut off export is all they will see.
+    for {
+        for _, rec := range page.Records {
+            if err := write(rec); err != nil {
+                loggerFrom(ctx).Error("audit export failed", "error", err)
+                return nil
+            }
+        }
+        if page.NextCursor == "" {
+            break
+        }
+        q.After = page.Records[len(page.Records)-1].ID
+        if page, err = s.store.GetAuditRecords(ctx, q); err != nil {
+            loggerFrom(ctx).Error("audit export failed", "error", err)
+            return nil
+        }
+    }
+    if err := flush(); err != nil {
+        loggerFrom(ctx).Error("audit export failed", "error", err)
+    }
+    return nil
+}
+
+func formatOptionalNumber(n *int64) string {
+    if n == nil {
+        return ""
+    }
+    return strconv.FormatInt(*n, 10)
+}
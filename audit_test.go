@@ -0,0 +1,142 @@
+package main
+
+import (
+    "bufio"
+    "encoding/csv"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T){
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    to := newTestAccount(t, store, 222222, 0)
+    admin := newTestAccount(t, store, 999999, 0)
+    store.UpdateAccountRole(ctx, admin.ID, RoleAdmin)
+    admin.Role = RoleAdmin
+    adminToken := loginAs(t, server, admin).Token
+
+    // The request ID of the client ends up in the record and the response
+    req := httptest.NewRequest("POST", "/transfer", strings.NewReader(`{"to_account": 222222, "amount": 40}`))
+    req.Header.Set("x-jwt-token", loginAs(t, server, from).Token)
+    req.Header.Set(requestIDHeader, "req-transfer-1")
+    rr := httptest.NewRecorder()
+    router.ServeHTTP(rr, req)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Equal(t, "req-transfer-1", rr.Header().Get(requestIDHeader))
+
+    // Requests without one get a made up ID
+    rr = doRequest(t, router, "POST", "/login", "", &LoginRequest{Number: to.Number, Password: "wrong"}, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    assert.NotEmpty(t, rr.Header().Get(requestIDHeader))
+
+    page := new(AuditPage)
+    rr = doRequest(t, router, "GET", "/audit?request_id=req-transfer-1", adminToken, nil, page)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Len(t, page.Records, 1)
+    rec := page.Records[0]
+    assert.Equal(t, AuditTransfer, rec.Action)
+    assert.Equal(t, from.Number, *rec.ActorNumber)
+    assert.Equal(t, RoleCustomer, rec.ActorRole)
+    assert.Equal(t, to.Number, *rec.TargetNumber)
+    assert.Equal(t, "192.0.2.1", rec.IP)
+    transfer := new(Transfer)
+    assert.Nil(t, json.Unmarshal(rec.After, transfer))
+    assert.Equal(t, int64(40), transfer.Amount)
+
+    page = new(AuditPage)
+    doRequest(t, router, "GET", "/audit?action=login.failed", adminToken, nil, page)
+    assert.Len(t, page.Records, 1)
+    assert.Nil(t, page.Records[0].ActorNumber)
+    assert.Equal(t, to.Number, *page.Records[0].TargetNumber)
+
+    // Deleting an account keeps what it looked like. It has to be paid out
+    // before it can go.
+    _, err := store.Withdraw(ctx, to.ID, 40)
+    assert.Nil(t, err)
+    rr = doRequest(t, router, "DELETE", "/account/2", adminToken, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    page = new(AuditPage)
+    doRequest(t, router, "GET", "/audit?action=account.deleted", adminToken, nil, page)
+    assert.Len(t, page.Records, 1)
+    deleted := new(Account)
+    assert.Nil(t, json.Unmarshal(page.Records[0].Before, deleted))
+    assert.Equal(t, to.Number, deleted.Number)
+    assert.Equal(t, admin.Number, *page.Records[0].ActorNumber)
+
+    // Pagination, newest first
+    page = new(AuditPage)
+    doRequest(t, router, "GET", "/audit?limit=2", adminToken, nil, page)
+    assert.Len(t, page.Records, 2)
+    assert.Equal(t, AuditAccountDeleted, page.Records[0].Action)
+    assert.NotEmpty(t, page.NextCursor)
+    next := new(AuditPage)
+    doRequest(t, router, "GET", "/audit?limit=2&cursor="+page.NextCursor, adminToken, nil, next)
+    assert.Len(t, next.Records, 1)
+    assert.Equal(t, AuditTransfer, next.Records[0].Action)
+    assert.Empty(t, next.NextCursor)
+
+    rr = doRequest(t, router, "GET", "/audit?from=yesterday", adminToken, nil, nil)
+    assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+    // Only admins get to read it
+    teller := newTestAccount(t, store, 333333, 0)
+    store.UpdateAccountRole(ctx, teller.ID, RoleTeller)
+    teller.Role = RoleTeller
+    tellerToken := loginAs(t, server, teller).Token
+    rr = doRequest(t, router, "GET", "/audit", tellerToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "GET", "/audit/export", loginAs(t, server, from).Token, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestAuditExport(t *testing.T){
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    newTestAccount(t, store, 222222, 0)
+    admin := newTestAccount(t, store, 999999, 0)
+    store.UpdateAccountRole(ctx, admin.ID, RoleAdmin)
+    admin.Role = RoleAdmin
+    adminToken := loginAs(t, server, admin).Token
+    fromToken := loginAs(t, server, from).Token
+    for i := 0; i < 3; i++ {
+        rr := doRequest(t, router, "POST", "/transfer", fromToken, TransferRequest{ToAccount: 222222, Amount: 10}, nil)
+        assert.Equal(t, http.StatusOK, rr.Code)
+    }
+
+    rr := doRequest(t, router, "GET", "/audit/export?action=transfer", adminToken, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+    assert.Contains(t, rr.Header().Get("Content-Disposition"), "attachment")
+    lines := 0
+    scanner := bufio.NewScanner(rr.Body)
+    for scanner.Scan() {
+        rec := new(AuditRecord)
+        assert.Nil(t, json.Unmarshal(scanner.Bytes(), rec))
+        assert.Equal(t, AuditTransfer, rec.Action)
+        lines++
+    }
+    assert.Equal(t, 3, lines)
+
+    rr = doRequest(t, router, "GET", "/audit/export?action=transfer&format=csv", adminToken, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"))
+    rows, err := csv.NewReader(rr.Body).ReadAll()
+    assert.Nil(t, err)
+    assert.Len(t, rows, 4)
+    assert.Equal(t, "action", rows[0][2])
+    assert.Equal(t, "111111", rows[1][3])
+
+    rr = doRequest(t, router, "GET", "/audit/export?format=xml", adminToken, nil, nil)
+    assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+    // Exports show up in the log themselves
+    page := new(AuditPage)
+    doRequest(t, router, "GET", "/audit?action=audit.exported", adminToken, nil, page)
+    assert.Len(t, page.Records, 2)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "net/http"
+    "slices"
+)
+
+// -- ROLES AND POLICIES
+// Every account has a role which is stored with the account and embedded in
+// the access token. withJWT only answers "who is calling", the decorators in
+// here answer "are they allowed to do this" and always have to sit inside of
+// withJWT:
+//
+//     withJWT(withRole(handler, RoleAdmin), store, keys)
+
+const (
+    RoleCustomer = "customer"
+    RoleTeller   = "teller"
+    RoleAdmin    = "admin"
+)
+
+// Staff can look at (and act on) accounts other than their own
+var staffRoles = []string{RoleTeller, RoleAdmin}
+
+func validRole(role string) bool {
+    return role == RoleCustomer || role == RoleTeller || role == RoleAdmin
+}
+
+func isStaff(role string) bool {
+    return slices.Contains(staffRoles, role)
+}
+
+// Only letting callers with one of the given roles through
+func withRole(handlerFunc http.HandlerFunc, roles ...string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        account, ok := authAccount(r)
+        if !ok {
+            writeError(w, r, ErrNotAuthenticated)
+            return
+        }
+        if !slices.Contains(roles, account.Role) {
+            permissionDenied(w, r)
+            return
+        }
+        handlerFunc(w, r)
+    }
+}
+
+// For routes like /account/{id}: customers may only get at their own account,
+// callers with one of the given roles may get at any account.
+func withOwnerOrRole(handlerFunc http.HandlerFunc, roles ...string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        account, ok := authAccount(r)
+        if !ok {
+            writeError(w, r, ErrNotAuthenticated)
+            return
+        }
+        if slices.Contains(roles, account.Role) {
+            handlerFunc(w, r)
+            return
+        }
+        id, err := getID(r)
+        if err != nil || id != account.ID {
+            permissionDenied(w, r)
+            return
+        }
+        handlerFunc(w, r)
+    }
+}
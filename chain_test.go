@@ -0,0 +1,111 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestChainHash(t *testing.T){
+    entry := newTransferEntry(1, 2, 50)
+    entry.PostedAt = time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC)
+    entry.Postings[0].BalanceAfter = 50
+    entry.Postings[1].BalanceAfter = 50
+    entry.seal(chainGenesis)
+    assert.Len(t, entry.Hash, 64)
+    // Only what PostgreSQL can store ends up in the hash
+    assert.Equal(t, 123456000, entry.PostedAt.Nanosecond())
+    assert.Equal(t, entry.Hash, entry.chainHash(chainGenesis))
+
+    // Same content, different place in the chain
+    assert.NotEqual(t, entry.Hash, entry.chainHash(entry.Hash))
+    entry.Postings[1].Amount = 51
+    assert.NotEqual(t, entry.Hash, entry.chainHash(chainGenesis))
+}
+
+func TestVerifyLedgerChain(t *testing.T){
+    store := NewMemoryStore()
+    from := newTestAccount(t, store, 111111, 100)
+    newTestAccount(t, store, 222222, 0)
+    for i := 0; i < 3; i++ {
+        _, err := store.Transfer(ctx, from.ID, 222222, 10)
+        assert.Nil(t, err)
+    }
+
+    report, err := store.VerifyLedgerChain(ctx)
+    assert.Nil(t, err)
+    assert.True(t, report.Intact())
+    // The opening deposit and three transfers
+    assert.Equal(t, int64(4), report.Records)
+    assert.Equal(t, store.entries[3].Hash, report.Head)
+
+    // Somebody quietly makes a transfer bigger
+    store.entries[2].Postings[1].Amount = 1000
+    report, err = store.VerifyLedgerChain(ctx)
+    assert.Nil(t, err)
+    assert.False(t, report.Intact())
+    assert.Equal(t, int64(3), report.Broken.ID)
+    assert.Equal(t, store.entries[2].Hash, report.Broken.Found)
+    assert.Equal(t, store.entries[1].Hash, report.Head)
+    store.entries[2].Postings[1].Amount = 10
+
+    // or makes one disappear, which breaks the link of the next one
+    store.entries = append(store.entries[:1], store.entries[2:]...)
+    report, err = store.VerifyLedgerChain(ctx)
+    assert.Nil(t, err)
+    assert.Equal(t, int64(3), report.Broken.ID)
+}
+
+func TestVerifyChainUnchained(t *testing.T){
+    store := NewMemoryStore()
+    acc := newTestAccount(t, store, 111111, 100)
+    // Entries from before the chain existed are fine, but only at the start
+    store.entries[0].Hash = ""
+    store.Deposit(ctx, acc.ID, 10)
+    store.Deposit(ctx, acc.ID, 10)
+    report, _ := store.VerifyLedgerChain(ctx)
+    assert.True(t, report.Intact())
+    assert.Equal(t, int64(1), report.Unchained)
+
+    store.entries[2].Hash = ""
+    report, _ = store.VerifyLedgerChain(ctx)
+    assert.False(t, report.Intact())
+    assert.Equal(t, int64(3), report.Broken.ID)
+    assert.Empty(t, report.Broken.Found)
+}
+
+func TestVerifyEndpoint(t *testing.T){
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    newTestAccount(t, store, 222222, 0)
+    admin := newTestAccount(t, store, 999999, 0)
+    store.UpdateAccountRole(ctx, admin.ID, RoleAdmin)
+    admin.Role = RoleAdmin
+    adminToken := loginAs(t, server, admin).Token
+    fromToken := loginAs(t, server, from).Token
+
+    transfer := new(Transfer)
+    rr := doRequest(t, router, "POST", "/transfer", fromToken, TransferRequest{ToAccount: 222222, Amount: 10}, transfer)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Len(t, transfer.Hash, 64)
+    doRequest(t, router, "POST", "/transfer", fromToken, TransferRequest{ToAccount: 222222, Amount: 10}, nil)
+
+    report := new(IntegrityReport)
+    rr = doRequest(t, router, "GET", "/verify", adminToken, nil, report)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.True(t, report.Intact)
+    assert.Equal(t, int64(2), report.AuditLog.Records)
+
+    // Rewriting history in the audit log
+    store.auditLog[0].IP = "198.51.100.7"
+    report = new(IntegrityReport)
+    doRequest(t, router, "GET", "/verify", adminToken, nil, report)
+    assert.False(t, report.Intact)
+    assert.True(t, report.Ledger.Intact())
+    assert.Equal(t, int64(1), report.AuditLog.Broken.ID)
+
+    rr = doRequest(t, router, "GET", "/verify", fromToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/fs"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "time"
+
+    "github.com/joho/godotenv"
+    "gopkg.in/yaml.v3"
+)
+
+// -- CONFIGURATION
+// Everything the server can be configured with lives in one typed Config,
+// which is put together once at startup from (lowest to highest precedence):
+//
+//     1. the defaults below
+//     2. an optional YAML or JSON file (-config or GO_BANK_CONFIG)
+//     3. environment variables (a .env file is loaded into them if present)
+//     4. command line flags that were actually given
+//
+// The result is validated as a whole before anything gets started, so a
+// broken setup fails right away with every problem listed instead of
+// somewhere in the middle of a request.
+
+type Config struct {
+    ListenAddr string         `json:"listen_addr" yaml:"listen_addr"`
+    Server     ServerConfig   `json:"server" yaml:"server"`
+    Store      string         `json:"store" yaml:"store"`
+    Database   DatabaseConfig `json:"database" yaml:"database"`
+    Auth       AuthConfig     `json:"auth" yaml:"auth"`
+    // Where notifications go, empty means the log (see notify.go)
+    NotifyFile string    `json:"notify_file" yaml:"notify_file"`
+    Features   Features  `json:"features" yaml:"features"`
+    Log        LogConfig `json:"log" yaml:"log"`
+    Tracing    TracingConfig `json:"tracing" yaml:"tracing"`
+}
+
+// Limits of the HTTP server. Without them a client that sends its request (or
+// reads the response) one byte at a time could hold a connection forever.
+type ServerConfig struct {
+    ReadHeaderTimeout Duration `json:"read_header_timeout" yaml:"read_header_timeout"`
+    ReadTimeout       Duration `json:"read_timeout" yaml:"read_timeout"`
+    WriteTimeout      Duration `json:"write_timeout" yaml:"write_timeout"`
+    IdleTimeout       Duration `json:"idle_timeout" yaml:"idle_timeout"`
+    MaxHeaderBytes    int      `json:"max_header_bytes" yaml:"max_header_bytes"`
+    // How long /readyz fails before the server stops accepting connections
+    DrainDelay Duration `json:"drain_delay" yaml:"drain_delay"`
+    // How long requests that are still running get to finish on shutdown
+    ShutdownTimeout Duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+}
+
+func DefaultServerConfig() ServerConfig {
+    return ServerConfig{
+        ReadHeaderTimeout: Duration(5 * time.Second),
+        ReadTimeout: Duration(15 * time.Second),
+        // Long enough for an audit export of a busy day
+        WriteTimeout: Duration(60 * time.Second),
+        IdleTimeout: Duration(2 * time.Minute),
+        MaxHeaderBytes: 64 << 10,
+        ShutdownTimeout: Duration(30 * time.Second),
+    }
+}
+
+type DatabaseConfig struct {
+    URL             string   `json:"url" yaml:"url"`
+    MaxOpenConns    int      `json:"max_open_conns" yaml:"max_open_conns"`
+    MaxIdleConns    int      `json:"max_idle_conns" yaml:"max_idle_conns"`
+    ConnMaxLifetime Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime"`
+    ConnMaxIdleTime Duration `json:"conn_max_idle_time" yaml:"conn_max_idle_time"`
+    // How long a single operation (a query or a whole transaction) may take,
+    // on top of the request being cancelled when the client goes away
+    QueryTimeout    Duration `json:"query_timeout" yaml:"query_timeout"`
+}
+
+type AuthConfig struct {
+    // Directory with the PEM keys and the one that signs, see keys.go
+    KeysDir    string `json:"keys_dir" yaml:"keys_dir"`
+    SigningKey string `json:"signing_key" yaml:"signing_key"`
+    // Signing with a throwaway key instead, for local development only
+    DevKeys    bool     `json:"dev_keys" yaml:"dev_keys"`
+    AccessTTL  Duration `json:"access_ttl" yaml:"access_ttl"`
+    RefreshTTL Duration `json:"refresh_ttl" yaml:"refresh_ttl"`
+}
+
+func (a AuthConfig) TokenConfig() TokenConfig {
+    return TokenConfig{
+        AccessTTL: time.Duration(a.AccessTTL),
+        RefreshTTL: time.Duration(a.RefreshTTL),
+    }
+}
+
+// Parts of the API that can be switched off. Turning off TOTP only stops new
+// enrolments, accounts that already have it keep needing their codes.
+type Features struct {
+    Signup        bool `json:"signup" yaml:"signup"`
+    TOTP          bool `json:"totp" yaml:"totp"`
+    PasswordReset bool `json:"password_reset" yaml:"password_reset"`
+    // GET /metrics, for when Prometheus scrapes some other way
+    Metrics bool `json:"metrics" yaml:"metrics"`
+    // GET /openapi.json and the Swagger UI at /docs/
+    Docs bool `json:"docs" yaml:"docs"`
+}
+
+func DefaultFeatures() Features {
+    return Features{Signup: true, TOTP: true, PasswordReset: true, Metrics: true, Docs: true}
+}
+
+func DefaultConfig() *Config {
+    tokens := DefaultTokenConfig()
+    return &Config{
+        ListenAddr: ":3000",
+        Server: DefaultServerConfig(),
+        Store: "postgres",
+        Database: DatabaseConfig{
+            MaxOpenConns: 25,
+            MaxIdleConns: 5,
+            ConnMaxLifetime: Duration(30 * time.Minute),
+            ConnMaxIdleTime: Duration(5 * time.Minute),
+            QueryTimeout: Duration(5 * time.Second),
+        },
+        Auth: AuthConfig{
+            AccessTTL: Duration(tokens.AccessTTL),
+            RefreshTTL: Duration(tokens.RefreshTTL),
+        },
+        Features: DefaultFeatures(),
+        Log: LogConfig{Level: slog.LevelInfo, Format: LogFormatJSON},
+        Tracing: TracingConfig{Exporter: TraceExporterNone, SampleRatio: 1},
+    }
+}
+
+// A time.Duration that is written as "15m" or "168h" in files and env vars
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+    v, err := time.ParseDuration(string(text))
+    if err != nil {
+        return fmt.Errorf("invalid duration %q", text)
+    }
+    *d = Duration(v)
+    return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+    return []byte(time.Duration(d).String()), nil
+}
+
+// The command line flags that can override the config. Only the ones that
+// were actually given win over the file and the environment.
+type ConfigFlags struct {
+    set     *flag.FlagSet
+    path    string
+    listen  string
+    store   string
+    devKeys bool
+}
+
+func RegisterConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+    f := &ConfigFlags{set: fs}
+    fs.StringVar(&f.path, "config", "", "YAML or JSON config file (default $GO_BANK_CONFIG)")
+    fs.StringVar(&f.listen, "listen", "", "address to listen on (default :3000)")
+    fs.StringVar(&f.store, "store", "", "storage backend to use: postgres or memory (default postgres)")
+    fs.BoolVar(&f.devKeys, "dev-keys", false, "sign tokens with a throwaway key instead of auth.keys_dir")
+    return f
+}
+
+func (f *ConfigFlags) apply(cfg *Config) {
+    f.set.Visit(func(fl *flag.Flag) {
+        switch fl.Name {
+        case "listen":
+            cfg.ListenAddr = f.listen
+        case "store":
+            cfg.Store = f.store
+        case "dev-keys":
+            cfg.Auth.DevKeys = f.devKeys
+        }
+    })
+}
+
+// The .env file used to be required, now it is only a convenience for local
+// development: a missing one is fine, a broken one is not. Variables that are
+// already set are never overwritten by it.
+func loadDotEnv() error {
+    err := godotenv.Load()
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return fmt.Errorf("loading .env: %w", err)
+    }
+    return nil
+}
+
+func LoadConfig(flags *ConfigFlags, getenv func(string) string) (*Config, error) {
+    cfg := DefaultConfig()
+    path := flags.path
+    if path == "" {
+        path = getenv("GO_BANK_CONFIG")
+    }
+    if path != "" {
+        if err := cfg.loadFile(path); err != nil {
+            return nil, err
+        }
+    }
+    if err := cfg.applyEnv(getenv); err != nil {
+        return nil, err
+    }
+    flags.apply(cfg)
+    if err := cfg.Validate(); err != nil {
+        return nil, err
+    }
+    return cfg, nil
+}
+
+// Settings that are missing from the file keep their defaults, settings that
+// are not known at all are an error (most likely a typo).
+func (c *Config) loadFile(path string) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("reading config file: %w", err)
+    }
+    switch filepath.Ext(path) {
+    case ".json":
+        dec := json.NewDecoder(bytes.NewReader(data))
+        dec.DisallowUnknownFields()
+        err = dec.Decode(c)
+    case ".yaml", ".yml":
+        dec := yaml.NewDecoder(bytes.NewReader(data))
+        dec.KnownFields(true)
+        err = dec.Decode(c)
+        // An empty file is a valid (if pointless) config
+        if errors.Is(err, io.EOF) {
+            err = nil
+        }
+    default:
+        return fmt.Errorf("config file %s has to end in .json, .yaml or .yml", path)
+    }
+    if err != nil {
+        return fmt.Errorf("parsing config file %s: %w", path, err)
+    }
+    return nil
+}
+
+type envVar struct {
+    name string
+    dst  any
+}
+
+// The environment variables every setting can be taken from. The names are
+// the ones that the server has always read (DATABASE_URL, JWT_*, NOTIFY_FILE).
+func (c *Config) envVars() []envVar {
+    return []envVar{
+        {"LISTEN_ADDR", &c.ListenAddr},
+        {"SERVER_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout},
+        {"SERVER_READ_TIMEOUT", &c.Server.ReadTimeout},
+        {"SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout},
+        {"SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout},
+        {"SERVER_MAX_HEADER_BYTES", &c.Server.MaxHeaderBytes},
+        {"SERVER_DRAIN_DELAY", &c.Server.DrainDelay},
+        {"SERVER_SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout},
+        {"STORE", &c.Store},
+        {"DATABASE_URL", &c.Database.URL},
+        {"DB_MAX_OPEN_CONNS", &c.Database.MaxOpenConns},
+        {"DB_MAX_IDLE_CONNS", &c.Database.MaxIdleConns},
+        {"DB_CONN_MAX_LIFETIME", &c.Database.ConnMaxLifetime},
+        {"DB_CONN_MAX_IDLE_TIME", &c.Database.ConnMaxIdleTime},
+        {"DB_QUERY_TIMEOUT", &c.Database.QueryTimeout},
+        {"JWT_KEYS_DIR", &c.Auth.KeysDir},
+        {"JWT_SIGNING_KEY", &c.Auth.SigningKey},
+        {"JWT_ACCESS_TTL", &c.Auth.AccessTTL},
+        {"JWT_REFRESH_TTL", &c.Auth.RefreshTTL},
+        {"NOTIFY_FILE", &c.NotifyFile},
+        {"FEATURE_SIGNUP", &c.Features.Signup},
+        {"FEATURE_TOTP", &c.Features.TOTP},
+        {"FEATURE_PASSWORD_RESET", &c.Features.PasswordReset},
+        {"FEATURE_METRICS", &c.Features.Metrics},
+        {"FEATURE_DOCS", &c.Features.Docs},
+        {"LOG_LEVEL", &c.Log.Level},
+        {"LOG_FORMAT", &c.Log.Format},
+        {"TRACING_EXPORTER", &c.Tracing.Exporter},
+        {"TRACING_FILE", &c.Tracing.File},
+        {"TRACING_SAMPLE_RATIO", &c.Tracing.SampleRatio},
+    }
+}
+
+func (c *Config) applyEnv(getenv func(string) string) error {
+    var errs []error
+    for _, v := range c.envVars() {
+        s := getenv(v.name)
+        if s == "" {
+            continue
+        }
+        var err error
+        switch dst := v.dst.(type) {
+        case *string:
+            *dst = s
+        case *int:
+            *dst, err = strconv.Atoi(s)
+        case *bool:
+            *dst, err = strconv.ParseBool(s)
+        case *float64:
+            *dst, err = strconv.ParseFloat(s, 64)
+        case *Duration:
+            err = dst.UnmarshalText([]byte(s))
+        case *slog.Level:
+            err = dst.UnmarshalText([]byte(s))
+        }
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: cannot use %q", v.name, s))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// Checking everything at once, the error lists every problem on its own line
+func (c *Config) Validate() error {
+    var errs []error
+    check := func(ok bool, format string, args ...any) {
+        if !ok {
+            errs = append(errs, fmt.Errorf(format, args...))
+        }
+    }
+
+    _, _, err := net.SplitHostPort(c.ListenAddr)
+    check(err == nil, "listen_addr %q is not a host:port address", c.ListenAddr)
+    srv := c.Server
+    check(srv.ReadHeaderTimeout > 0, "server.read_header_timeout must be positive")
+    check(srv.ReadTimeout > 0, "server.read_timeout must be positive")
+    check(srv.WriteTimeout > 0, "server.write_timeout must be positive")
+    check(srv.IdleTimeout > 0, "server.idle_timeout must be positive")
+    check(srv.MaxHeaderBytes >= 1<<10, "server.max_header_bytes must be at least 1024")
+    check(srv.DrainDelay >= 0, "server.drain_delay must not be negative")
+    check(srv.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+    check(c.Store == "postgres" || c.Store == "memory", "store must be postgres or memory, got %q", c.Store)
+    if c.Store == "postgres" {
+        check(c.Database.URL != "", "database.url (DATABASE_URL) is required for the postgres store")
+    }
+
+    db := c.Database
+    check(db.MaxOpenConns >= 0, "database.max_open_conns must not be negative")
+    check(db.MaxIdleConns >= 0, "database.max_idle_conns must not be negative")
+    check(db.MaxOpenConns == 0 || db.MaxIdleConns <= db.MaxOpenConns,
+        "database.max_idle_conns cannot be more than database.max_open_conns")
+    check(db.ConnMaxLifetime >= 0, "database.conn_max_lifetime must not be negative")
+    check(db.ConnMaxIdleTime >= 0, "database.conn_max_idle_time must not be negative")
+    check(db.QueryTimeout > 0, "database.query_timeout must be positive")
+
+    auth := c.Auth
+    check(auth.AccessTTL > 0, "auth.access_ttl must be positive")
+    check(auth.RefreshTTL > 0, "auth.refresh_ttl must be positive")
+    check(auth.RefreshTTL > auth.AccessTTL, "auth.refresh_ttl has to be longer than auth.access_ttl")
+    check(c.Log.Format == LogFormatJSON || c.Log.Format == LogFormatText,
+        "log.format must be json or text, got %q", c.Log.Format)
+
+    tr := c.Tracing
+    switch tr.Exporter {
+    case TraceExporterNone, TraceExporterStdout, TraceExporterOTLP:
+    case TraceExporterFile:
+        check(tr.File != "", "tracing.file (TRACING_FILE) is required for the file exporter")
+    default:
+        check(false, "tracing.exporter must be none, stdout, file or otlp, got %q", tr.Exporter)
+    }
+    check(tr.SampleRatio >= 0 && tr.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+    return errors.Join(errs...)
+}
+
+var ErrFeatureDisabled = NewAPIError(http.StatusNotFound, "feature_disabled", "this feature is disabled")
+
+// Switched off features answer as if the route was not there, with an error
+// that says why.
+func withFeature(handlerFunc http.HandlerFunc, enabled bool) http.HandlerFunc {
+    if enabled {
+        return handlerFunc
+    }
+    return func(w http.ResponseWriter, r *http.Request) {
+        writeError(w, r, ErrFeatureDisabled)
+    }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "flag"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func parseConfigFlags(t *testing.T, args ...string) *ConfigFlags {
+    fs := flag.NewFlagSet("go-bank", flag.ContinueOnError)
+    flags := RegisterConfigFlags(fs)
+    assert.Nil(t, fs.Parse(args))
+    return flags
+}
+
+func envFrom(vars map[string]string) func(string) string {
+    return func(name string) string {
+        return vars[name]
+    }
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+    path := filepath.Join(t.TempDir(), name)
+    assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+    return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T){
+    path := writeConfigFile(t, "go-bank.yaml", `
+listen_addr: ":4000"
+store: memory
+database:
+  max_open_conns: 50
+auth:
+  access_ttl: 5m
+features:
+  totp: false
+`)
+    env := envFrom(map[string]string{
+        "LISTEN_ADDR": ":5000",
+        "DB_MAX_IDLE_CONNS": "10",
+        "FEATURE_SIGNUP": "false",
+        "LOG_LEVEL": "debug",
+    })
+
+    // file < env < flags, and everything else keeps its default
+    cfg, err := LoadConfig(parseConfigFlags(t, "-config", path, "-listen", ":6000"), env)
+    assert.Nil(t, err)
+    assert.Equal(t, ":6000", cfg.ListenAddr)
+    assert.Equal(t, "memory", cfg.Store)
+    assert.Equal(t, 50, cfg.Database.MaxOpenConns)
+    assert.Equal(t, 10, cfg.Database.MaxIdleConns)
+    assert.Equal(t, Duration(30*time.Minute), cfg.Database.ConnMaxLifetime)
+    assert.Equal(t, 5*time.Minute, cfg.Auth.TokenConfig().AccessTTL)
+    assert.Equal(t, DefaultTokenConfig().RefreshTTL, cfg.Auth.TokenConfig().RefreshTTL)
+    assert.Equal(t, Features{Signup: false, TOTP: false, PasswordReset: true, Metrics: true, Docs: true}, cfg.Features)
+    assert.Equal(t, LogConfig{Level: slog.LevelDebug, Format: LogFormatJSON}, cfg.Log)
+
+    cfg, err = LoadConfig(parseConfigFlags(t, "-config", path), env)
+    assert.Nil(t, err)
+    assert.Equal(t, ":5000", cfg.ListenAddr)
+
+    // The file can come from the environment, too
+    jsonPath := writeConfigFile(t, "go-bank.json", `{"store": "memory", "auth": {"refresh_ttl": "24h"}}`)
+    cfg, err = LoadConfig(parseConfigFlags(t), envFrom(map[string]string{"GO_BANK_CONFIG": jsonPath}))
+    assert.Nil(t, err)
+    assert.Equal(t, Duration(24*time.Hour), cfg.Auth.RefreshTTL)
+}
+
+func TestLoadConfigErrors(t *testing.T){
+    // Postgres is the default store, and it needs a database
+    _, err := LoadConfig(parseConfigFlags(t), envFrom(nil))
+    assert.ErrorContains(t, err, "database.url")
+
+    // Every problem is reported at once
+    _, err = LoadConfig(parseConfigFlags(t, "-store", "memory", "-listen", "3000"), envFrom(map[string]string{
+        "DB_MAX_OPEN_CONNS": "2",
+        "DB_MAX_IDLE_CONNS": "5",
+        "DB_QUERY_TIMEOUT": "0s",
+        "LOG_FORMAT": "xml",
+        "TRACING_EXPORTER": "file",
+        "TRACING_SAMPLE_RATIO": "1.5",
+        "JWT_ACCESS_TTL": "2h",
+        "JWT_REFRESH_TTL": "1h",
+    }))
+    assert.ErrorContains(t, err, "listen_addr")
+    assert.ErrorContains(t, err, "database.max_idle_conns")
+    assert.ErrorContains(t, err, "database.query_timeout")
+    assert.ErrorContains(t, err, "log.format")
+    assert.ErrorContains(t, err, "tracing.file")
+    assert.ErrorContains(t, err, "tracing.sample_ratio")
+    assert.ErrorContains(t, err, "auth.refresh_ttl")
+
+    _, err = LoadConfig(parseConfigFlags(t), envFrom(map[string]string{"DB_MAX_OPEN_CONNS": "lots"}))
+    assert.ErrorContains(t, err, "DB_MAX_OPEN_CONNS")
+
+    // Typos in the file are not silently ignored
+    path := writeConfigFile(t, "go-bank.yaml", "listen_adr: \":4000\"\n")
+    _, err = LoadConfig(parseConfigFlags(t, "-config", path), envFrom(nil))
+    assert.ErrorContains(t, err, "listen_adr")
+
+    path = writeConfigFile(t, "go-bank.toml", "")
+    _, err = LoadConfig(parseConfigFlags(t, "-config", path), envFrom(nil))
+    assert.NotNil(t, err)
+
+    _, err = LoadConfig(parseConfigFlags(t, "-config", "missing.yaml"), envFrom(nil))
+    assert.NotNil(t, err)
+}
+
+func TestDisabledFeatures(t *testing.T){
+    server, _, _ := newTestServer()
+    server.features = Features{Signup: false, TOTP: true, PasswordReset: false}
+    router := server.Router()
+
+    apiErr := new(APIError)
+    rr := doRequest(t, router, "POST", "/account", "", CreateAccountRequest{"a", "b", "hello123"}, apiErr)
+    assert.Equal(t, http.StatusNotFound, rr.Code)
+    assert.Equal(t, "feature_disabled", apiErr.Code)
+    rr = doRequest(t, router, "POST", "/password/reset/request", "", map[string]int64{"number": 111111}, nil)
+    assert.Equal(t, http.StatusNotFound, rr.Code)
+}
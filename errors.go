@@ -0,0 +1,94 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+)
+
+// -- API ERRORS
+// Every error that is meant to reach a client is an *APIError. It carries the
+// HTTP status to respond with, a stable machine readable code that clients
+// can switch on (the message is for humans and may change) and optionally
+// some details. Anything else that bubbles up to makeHTTPHandleFunc is treated
+// as an internal error: it gets logged and the client only ever sees a generic
+// 500, so database errors and the like never leak out.
+
+type APIError struct {
+    Status  int    `json:"-"`
+    Code    string `json:"code"`
+    Message string `json:"error"`
+    Details any    `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+    return e.Message
+}
+
+// Two API errors are the same error if they have the same code, which lets
+// errors.Is(err, ErrAccountNotFound) match "account 42 not found" as well.
+func (e *APIError) Is(target error) bool {
+    t, ok := target.(*APIError)
+    return ok && t.Code == e.Code
+}
+
+func NewAPIError(status int, code string, format string, args ...any) *APIError {
+    return &APIError{
+        Status: status,
+        Code: code,
+        Message: fmt.Sprintf(format, args...),
+    }
+}
+
+// Returning a copy with details attached, the sentinel values below must
+// never be modified.
+func (e *APIError) WithDetails(details any) *APIError {
+    c := *e
+    c.Details = details
+    return &c
+}
+
+// Generic errors which do not belong to any particular part of the code
+var (
+    ErrNotAuthenticated   = NewAPIError(http.StatusUnauthorized, "unauthenticated", "Not authenticated")
+    ErrInvalidCredentials = NewAPIError(http.StatusUnauthorized, "invalid_credentials", "invalid account number or password")
+    ErrPermissionDenied   = NewAPIError(http.StatusForbidden, "permission_denied", "permission denied")
+    ErrInvalidJSON        = NewAPIError(http.StatusBadRequest, "invalid_json", "request body is not valid JSON")
+    ErrInternal           = NewAPIError(http.StatusInternalServerError, "internal_error", "internal server error")
+    ErrTimeout            = NewAPIError(http.StatusServiceUnavailable, "timeout", "the request took too long, try again later")
+)
+
+func errMethodNotAllowed(method string) error {
+    return NewAPIError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed %s", method)
+}
+
+func errBadRequest(format string, args ...any) error {
+    return NewAPIError(http.StatusBadRequest, "bad_request", format, args...)
+}
+
+// Turning whatever a handler returned into the error that the client gets
+// to see.
+func toAPIError(err error) *APIError {
+    var apiErr *APIError
+    if errors.As(err, &apiErr) {
+        return apiErr
+    }
+    // json.Decoder errors are the client's fault and are safe to show
+    var syntaxErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+        return ErrInvalidJSON.WithDetails(err.Error())
+    }
+    if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+        return ErrInvalidJSON
+    }
+    // A query that ran out of time (see PostgresStore.operation) is worth
+    // retrying, unlike whatever else went wrong. It is still logged.
+    if errors.Is(err, context.DeadlineExceeded) {
+        return ErrTimeout
+    }
+    return ErrInternal
+}
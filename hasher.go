@@ -0,0 +1,184 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "strings"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// -- PASSWORD HASHING
+// Every stored hash says which algorithm (and which parameters) made it, so
+// several hashers can live side by side: new passwords are always hashed with
+// the default one, older hashes keep working with whichever hasher recognises
+// them. When a password is verified against a hash from anything but the
+// default hasher with its current parameters, the caller gets told to rehash
+// it, which is how hashes get upgraded over time without anyone having to
+// reset their password.
+
+type PasswordHasher interface {
+    Hash(pw string) (string, error)
+    // Whether the encoded hash was made by this hasher at all
+    Recognizes(encoded string) bool
+    Verify(encoded, pw string) bool
+    // Whether the hash was made with weaker parameters than the current ones
+    Outdated(encoded string) bool
+}
+
+type PasswordHashing struct {
+    Default PasswordHasher
+    Legacy  []PasswordHasher
+}
+
+// Argon2id for everything new, bcrypt only for verifying the hashes from
+// before it came along.
+var passwordHashing = &PasswordHashing{
+    Default: &Argon2idHasher{Params: DefaultArgon2Params},
+    Legacy: []PasswordHasher{&BcryptHasher{Cost: bcrypt.DefaultCost}},
+}
+
+func (p *PasswordHashing) Hash(pw string) (string, error) {
+    return p.Default.Hash(pw)
+}
+
+// Checking a password against a stored hash. rehash is only ever true for a
+// correct password, the hash should then be replaced with a new Hash().
+func (p *PasswordHashing) Verify(encoded, pw string) (ok bool, rehash bool) {
+    if p.Default.Recognizes(encoded) {
+        ok = p.Default.Verify(encoded, pw)
+        return ok, ok && p.Default.Outdated(encoded)
+    }
+    for _, h := range p.Legacy {
+        if h.Recognizes(encoded) {
+            ok = h.Verify(encoded, pw)
+            return ok, ok
+        }
+    }
+    return false, false
+}
+
+// -- ARGON2ID
+// Stored in the PHC string format that other argon2 implementations use too:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+
+type Argon2Params struct {
+    Memory     uint32 // in KiB
+    Iterations uint32
+    Threads    uint8
+    SaltLength uint32
+    KeyLength  uint32
+}
+
+var DefaultArgon2Params = Argon2Params{
+    Memory: 64 * 1024,
+    Iterations: 3,
+    Threads: 2,
+    SaltLength: 16,
+    KeyLength: 32,
+}
+
+type Argon2idHasher struct {
+    Params Argon2Params
+}
+
+const argon2idPrefix = "$argon2id$"
+
+var errInvalidArgon2Hash = errors.New("invalid argon2id hash")
+
+func (h *Argon2idHasher) Hash(pw string) (string, error) {
+    salt := make([]byte, h.Params.SaltLength)
+    if _, err := rand.Read(salt); err != nil {
+        return "", err
+    }
+    p := h.Params
+    key := argon2.IDKey([]byte(pw), salt, p.Iterations, p.Memory, p.Threads, p.KeyLength)
+    return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+        argon2idPrefix,
+        argon2.Version,
+        p.Memory,
+        p.Iterations,
+        p.Threads,
+        base64.RawStdEncoding.EncodeToString(salt),
+        base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Recognizes(encoded string) bool {
+    return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+func (h *Argon2idHasher) Verify(encoded, pw string) bool {
+    p, salt, key, err := decodeArgon2id(encoded)
+    if err != nil {
+        return false
+    }
+    other := argon2.IDKey([]byte(pw), salt, p.Iterations, p.Memory, p.Threads, p.KeyLength)
+    return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (h *Argon2idHasher) Outdated(encoded string) bool {
+    p, _, _, err := decodeArgon2id(encoded)
+    return err != nil || p != h.Params
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+    var p Argon2Params
+    // "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+    parts := strings.Split(encoded, "$")
+    if len(parts) != 6 || parts[1] != "argon2id" {
+        return p, nil, nil, errInvalidArgon2Hash
+    }
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return p, nil, nil, errInvalidArgon2Hash
+    }
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Threads); err != nil {
+        return p, nil, nil, errInvalidArgon2Hash
+    }
+    salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return p, nil, nil, errInvalidArgon2Hash
+    }
+    key, err := base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil || len(key) == 0 {
+        return p, nil, nil, errInvalidArgon2Hash
+    }
+    p.SaltLength = uint32(len(salt))
+    p.KeyLength = uint32(len(key))
+    return p, salt, key, nil
+}
+
+// -- BCRYPT
+// What every account created before Argon2id has. bcrypt hashes carry their
+// version and cost themselves ($2a$10$...).
+
+type BcryptHasher struct {
+    Cost int
+}
+
+func (h *BcryptHasher) Hash(pw string) (string, error) {
+    encpw, err := bcrypt.GenerateFromPassword([]byte(pw), h.Cost)
+    if err != nil {
+        return "", err
+    }
+    return string(encpw), nil
+}
+
+func (h *BcryptHasher) Recognizes(encoded string) bool {
+    return strings.HasPrefix(encoded, "$2a$") ||
+        strings.HasPrefix(encoded, "$2b$") ||
+        strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *BcryptHasher) Verify(encoded, pw string) bool {
+    return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pw)) == nil
+}
+
+func (h *BcryptHasher) Outdated(encoded string) bool {
+    cost, err := bcrypt.Cost([]byte(encoded))
+    return err != nil || cost < h.Cost
+}
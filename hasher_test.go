@@ -0,0 +1,80 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHasher(t *testing.T){
+    h := &Argon2idHasher{Params: Argon2Params{Memory: 1024, Iterations: 1, Threads: 1, SaltLength: 16, KeyLength: 32}}
+    encoded, err := h.Hash("hello123")
+    assert.Nil(t, err)
+    assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+    assert.True(t, h.Recognizes(encoded))
+    assert.True(t, h.Verify(encoded, "hello123"))
+    assert.False(t, h.Verify(encoded, "hello124"))
+    assert.False(t, h.Outdated(encoded))
+
+    // Same password, different salt
+    again, _ := h.Hash("hello123")
+    assert.NotEqual(t, encoded, again)
+
+    // Raising the cost makes the old hash outdated, but it still verifies
+    stronger := &Argon2idHasher{Params: h.Params}
+    stronger.Params.Iterations = 2
+    assert.True(t, stronger.Outdated(encoded))
+    assert.True(t, stronger.Verify(encoded, "hello123"))
+
+    for _, broken := range []string{"", "$argon2id$", "$argon2id$v=19$m=1024,t=1,p=1$!!$!!", "$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5"} {
+        assert.False(t, h.Verify(broken, "hello123"))
+    }
+}
+
+func TestPasswordHashingUpgrades(t *testing.T){
+    cheap := Argon2Params{Memory: 1024, Iterations: 1, Threads: 1, SaltLength: 16, KeyLength: 32}
+    p := &PasswordHashing{
+        Default: &Argon2idHasher{Params: cheap},
+        Legacy: []PasswordHasher{&BcryptHasher{Cost: bcrypt.MinCost}},
+    }
+    legacy, err := bcrypt.GenerateFromPassword([]byte("hello123"), bcrypt.MinCost)
+    assert.Nil(t, err)
+
+    ok, rehash := p.Verify(string(legacy), "hello123")
+    assert.True(t, ok)
+    assert.True(t, rehash)
+    // A wrong password is never a reason to rehash
+    ok, rehash = p.Verify(string(legacy), "wrong")
+    assert.False(t, ok)
+    assert.False(t, rehash)
+
+    current, _ := p.Hash("hello123")
+    ok, rehash = p.Verify(current, "hello123")
+    assert.True(t, ok)
+    assert.False(t, rehash)
+
+    ok, _ = p.Verify("plaintext", "plaintext")
+    assert.False(t, ok)
+}
+
+func TestLoginRehashesBcrypt(t *testing.T){
+    _, store, router := newTestServer()
+    legacy, err := bcrypt.GenerateFromPassword([]byte("hello123"), bcrypt.MinCost)
+    assert.Nil(t, err)
+    acc := &Account{Number: 123456, EncryptedPassword: string(legacy), Role: RoleCustomer}
+    assert.Nil(t, store.CreateAccount(ctx, acc))
+
+    rr := doRequest(t, router, "POST", "/login", "", LoginRequest{acc.Number, "hello123"}, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    stored, _ := store.GetAccountByID(ctx, acc.ID)
+    assert.True(t, strings.HasPrefix(stored.EncryptedPassword, argon2idPrefix))
+
+    // and the upgraded hash works from now on
+    rr = doRequest(t, router, "POST", "/login", "", LoginRequest{acc.Number, "hello123"}, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    again, _ := store.GetAccountByID(ctx, acc.ID)
+    assert.Equal(t, stored.EncryptedPassword, again.EncryptedPassword)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// -- HEALTH CHECKS
+// GET /healthz answers as long as the process can serve HTTP at all, it is
+// what liveness probes hit and it never looks at any dependency (a database
+// outage is no reason to restart us). GET /readyz says whether the server
+// should get traffic: the store has to answer a ping in time, the schema has
+// to be up to date and the server must not be shutting down. Every check is
+// reported on its own, the status code is 200 only if all of them passed.
+
+const readinessTimeout = 2 * time.Second
+
+const (
+    CheckOK      = "ok"
+    CheckFailing = "failing"
+)
+
+type HealthCheck struct {
+    Status    string `json:"status"`
+    Error     string `json:"error,omitempty"`
+    LatencyMS int64  `json:"latency_ms"`
+    // Only for the migrations check
+    Applied *int `json:"applied,omitempty"`
+    Pending *int `json:"pending,omitempty"`
+}
+
+type ReadinessReport struct {
+    Status   string                  `json:"status"`
+    Draining bool                    `json:"draining"`
+    Checks   map[string]*HealthCheck `json:"checks"`
+}
+
+// GET /healthz
+func (s *APIServer) handleHealthz(w http.ResponseWriter, r *http.Request) error {
+    return WriteJSON(w, http.StatusOK, map[string]string{"status": CheckOK})
+}
+
+// GET /readyz
+func (s *APIServer) handleReadyz(w http.ResponseWriter, r *http.Request) error {
+    ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+    defer cancel()
+
+    report := &ReadinessReport{
+        Status: "ready",
+        Draining: s.draining.Load(),
+        Checks: map[string]*HealthCheck{},
+    }
+    report.Checks["storage"] = runCheck(ctx, s.store.Ping)
+    // The memory store has no schema to migrate
+    if pg, ok := s.store.(*PostgresStore); ok {
+        var applied, pending int
+        check := runCheck(ctx, func(ctx context.Context) error {
+            migrator, err := NewMigrator(pg.db)
+            if err != nil {
+                return err
+            }
+            applied, pending, err = migrator.Pending(ctx)
+            if err == nil && pending > 0 {
+                return fmt.Errorf("%d migrations are pending", pending)
+            }
+            return err
+        })
+        check.Applied, check.Pending = &applied, &pending
+        report.Checks["migrations"] = check
+    }
+
+    status := http.StatusOK
+    if report.Draining {
+        status = http.StatusServiceUnavailable
+    }
+    for _, check := range report.Checks {
+        if check.Status != CheckOK {
+            status = http.StatusServiceUnavailable
+        }
+    }
+    if status != http.StatusOK {
+        report.Status = "not_ready"
+    }
+    return WriteJSON(w, status, report)
+}
+
+func runCheck(ctx context.Context, check func(context.Context) error) *HealthCheck {
+    start := time.Now()
+    err := check(ctx)
+    result := &HealthCheck{Status: CheckOK, LatencyMS: time.Since(start).Milliseconds()}
+    if err != nil {
+        result.Status = CheckFailing
+        result.Error = err.Error()
+    }
+    return result
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+// A store whose database has gone away
+type unreachableStore struct {
+    *MemoryStore
+}
+
+func (s unreachableStore) Ping(ctx context.Context) error {
+    return errors.New("dial tcp 127.0.0.1:5432: connection refused")
+}
+
+func TestHealthz(t *testing.T){
+    _, _, router := newTestServer()
+    rr := doRequest(t, router, "GET", "/healthz", "", nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestReadyz(t *testing.T){
+    server, _, router := newTestServer()
+
+    report := new(ReadinessReport)
+    rr := doRequest(t, router, "GET", "/readyz", "", nil, report)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Equal(t, "ready", report.Status)
+    assert.False(t, report.Draining)
+    assert.Equal(t, CheckOK, report.Checks["storage"].Status)
+
+    // Shutting down
+    server.draining.Store(true)
+    report = new(ReadinessReport)
+    rr = doRequest(t, router, "GET", "/readyz", "", nil, report)
+    assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+    assert.Equal(t, "not_ready", report.Status)
+    assert.True(t, report.Draining)
+
+    // The database is gone, which is no reason to restart the process
+    keys, _ := NewEphemeralKeyring()
+    router = NewAPIServer(":0", unreachableStore{NewMemoryStore()}, keys).Router()
+    report = new(ReadinessReport)
+    rr = doRequest(t, router, "GET", "/readyz", "", nil, report)
+    assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+    assert.Equal(t, CheckFailing, report.Checks["storage"].Status)
+    assert.Contains(t, report.Checks["storage"].Error, "connection refused")
+    rr = doRequest(t, router, "GET", "/healthz", "", nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+}
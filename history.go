@@ -0,0 +1,197 @@
+package main
+
+import (
+    "encoding/base64"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// -- TRANSACTION HISTORY
+// The history of an account is read straight from its postings in the
+// ledger. Each posting becomes one transaction from the point of view of that
+// account: money either came in (credit) or went out (debit).
+
+const (
+    DirectionCredit = "credit"
+    DirectionDebit  = "debit"
+)
+
+const (
+    defaultTransactionLimit = 50
+    maxTransactionLimit     = 200
+)
+
+type Transaction struct {
+    ID           int64     `json:"id"`
+    EntryID      int64     `json:"entry_id"`
+    Kind         string    `json:"kind"`
+    Direction    string    `json:"direction"`
+    Amount       int64     `json:"amount"`
+    BalanceAfter int64     `json:"balance_after"`
+    // Account number on the other side of a transfer. Deposits and
+    // withdrawals (and transfers with accounts that have since been deleted)
+    // do not have one.
+    Counterparty *int64    `json:"counterparty,omitempty"`
+    PostedAt     time.Time `json:"posted_at"`
+}
+
+type TransactionPage struct {
+    Transactions []*Transaction `json:"transactions"`
+    // Pass this back as the "cursor" query parameter to get the next page. It
+    // is left out once there is nothing more to fetch.
+    NextCursor   string         `json:"next_cursor,omitempty"`
+}
+
+// Filters for the transaction history. Zero values mean "no filter". From is
+// inclusive and To is exclusive, amounts are compared against the absolute
+// value of the transaction so that they work the same for both directions.
+type TransactionQuery struct {
+    After        int64
+    Limit        int
+    From         time.Time
+    To           time.Time
+    Direction    string
+    Counterparty int64
+    MinAmount    int64
+    MaxAmount    int64
+}
+
+// Transactions are returned newest first and the cursor is the ID of the last
+// transaction on the previous page. It is base64 encoded so that clients
+// treat it as an opaque value and we are free to change it later.
+func encodeCursor(id int64) string {
+    return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+    raw, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+        return 0, errBadRequest("Invalid cursor given %s", cursor)
+    }
+    id, err := strconv.ParseInt(string(raw), 10, 64)
+    if err != nil || id <= 0 {
+        return 0, errBadRequest("Invalid cursor given %s", cursor)
+    }
+    return id, nil
+}
+
+// Matching a single transaction against the filters of a query. The cursor
+// and the limit are not part of this, they are about paging and not about
+// which transactions belong in the result.
+func (q *TransactionQuery) Matches(t *Transaction) bool {
+    if !q.From.IsZero() && t.PostedAt.Before(q.From) {
+        return false
+    }
+    if !q.To.IsZero() && !t.PostedAt.Before(q.To) {
+        return false
+    }
+    if q.Direction != "" && t.Direction != q.Direction {
+        return false
+    }
+    if q.Counterparty != 0 && (t.Counterparty == nil || *t.Counterparty != q.Counterparty) {
+        return false
+    }
+    if q.MinAmount != 0 && t.Amount < q.MinAmount {
+        return false
+    }
+    if q.MaxAmount != 0 && t.Amount > q.MaxAmount {
+        return false
+    }
+    return true
+}
+
+// Building the transaction as seen by the owner of a posting
+func newTransaction(p *Posting, kind string, postedAt time.Time, counterparty *int64) *Transaction {
+    t := &Transaction{
+        ID: p.ID,
+        EntryID: p.EntryID,
+        Kind: kind,
+        Direction: DirectionCredit,
+        Amount: p.Amount,
+        BalanceAfter: p.BalanceAfter,
+        Counterparty: counterparty,
+        PostedAt: postedAt,
+    }
+    if p.Amount < 0 {
+        t.Direction = DirectionDebit
+        t.Amount = -p.Amount
+    }
+    return t
+}
+
+// Turning the query string of GET /account/{id}/transactions into a query.
+// Every parameter is optional:
+// cursor, limit, from, to (RFC 3339), direction (credit | debit),
+// counterparty (account number), min_amount, max_amount
+func parseTransactionQuery(r *http.Request) (*TransactionQuery, error) {
+    params := r.URL.Query()
+    q := &TransactionQuery{Limit: defaultTransactionLimit}
+
+    if v := params.Get("cursor"); v != "" {
+        after, err := decodeCursor(v)
+        if err != nil {
+            return nil, err
+        }
+        q.After = after
+    }
+    if v := params.Get("limit"); v != "" {
+        limit, err := strconv.Atoi(v)
+        if err != nil || limit <= 0 || limit > maxTransactionLimit {
+            return nil, errBadRequest("limit must be between 1 and %d", maxTransactionLimit)
+        }
+        q.Limit = limit
+    }
+    for name, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+        v := params.Get(name)
+        if v == "" {
+            continue
+        }
+        ts, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            return nil, errBadRequest("%s must be an RFC 3339 timestamp", name)
+        }
+        *dst = ts.UTC()
+    }
+    if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+        return nil, errBadRequest("from must be before to")
+    }
+
+    switch v := params.Get("direction"); v {
+    case "", DirectionCredit, DirectionDebit:
+        q.Direction = v
+    default:
+        return nil, errBadRequest("direction must be either %s or %s", DirectionCredit, DirectionDebit)
+    }
+
+    for name, dst := range map[string]*int64{
+        "counterparty": &q.Counterparty,
+        "min_amount": &q.MinAmount,
+        "max_amount": &q.MaxAmount,
+    } {
+        v := params.Get(name)
+        if v == "" {
+            continue
+        }
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n <= 0 {
+            return nil, errBadRequest("%s must be a positive number", name)
+        }
+        *dst = n
+    }
+    if q.MinAmount != 0 && q.MaxAmount != 0 && q.MinAmount > q.MaxAmount {
+        return nil, errBadRequest("min_amount cannot be greater than max_amount")
+    }
+    return q, nil
+}
+
+// The stores fetch one transaction more than they were asked for, which is
+// how we know whether there is another page without running a COUNT query.
+func newTransactionPage(txns []*Transaction, limit int) *TransactionPage {
+    page := &TransactionPage{Transactions: txns}
+    if len(txns) > limit {
+        page.Transactions = txns[:limit]
+        page.NextCursor = encodeCursor(txns[limit-1].ID)
+    }
+    return page
+}
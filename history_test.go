@@ -0,0 +1,41 @@
+package main
+
+import (
+    "net/http/httptest"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestCursorRoundTrip(t *testing.T){
+    id, err := decodeCursor(encodeCursor(42))
+    assert.Nil(t, err)
+    assert.Equal(t, int64(42), id)
+
+    _, err = decodeCursor("not-a-cursor")
+    assert.NotNil(t, err)
+}
+
+func TestParseTransactionQuery(t *testing.T){
+    r := httptest.NewRequest("GET", "/account/1/transactions?direction=debit&min_amount=10&from=2024-01-01T00:00:00Z", nil)
+    q, err := parseTransactionQuery(r)
+    assert.Nil(t, err)
+    assert.Equal(t, DirectionDebit, q.Direction)
+    assert.Equal(t, int64(10), q.MinAmount)
+    assert.Equal(t, defaultTransactionLimit, q.Limit)
+    assert.Equal(t, 2024, q.From.Year())
+
+    for _, bad := range []string{
+        "direction=sideways",
+        "limit=0",
+        "limit=100000",
+        "min_amount=-5",
+        "min_amount=10&max_amount=5",
+        "from=yesterday",
+        "from=2024-02-01T00:00:00Z&to=2024-01-01T00:00:00Z",
+    } {
+        r := httptest.NewRequest("GET", "/account/1/transactions?"+bad, nil)
+        _, err := parseTransactionQuery(r)
+        assert.NotNil(t, err, bad)
+    }
+}
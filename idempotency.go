@@ -0,0 +1,189 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// -- IDEMPOTENCY KEYS
+// Clients that retry a POST after a timeout have no way of knowing whether
+// the first attempt went through. By sending the same Idempotency-Key header
+// on every attempt they can be sure that the request is only acted upon once:
+// the first response gets stored and every retry is answered with it.
+
+const (
+    idempotencyHeader = "Idempotency-Key"
+    // Set on responses that were replayed from a stored record
+    idempotencyReplayedHeader = "Idempotent-Replayed"
+
+    maxIdempotencyKeyLength = 255
+)
+
+const (
+    // How long a key is remembered for, after that it can be reused
+    idempotencyKeyTTL = 24 * time.Hour
+    // A request that has not finished after this long is assumed to have
+    // died with the server, so its key can be picked up again.
+    idempotencyLockTimeout = time.Minute
+)
+
+var (
+    ErrIdempotencyKeyMismatch = NewAPIError(http.StatusUnprocessableEntity, "idempotency_key_mismatch",
+        "Idempotency-Key has already been used for a different request")
+    ErrIdempotencyKeyInUse = NewAPIError(http.StatusConflict, "idempotency_key_in_use",
+        "a request with this Idempotency-Key is still being processed")
+)
+
+// A record is created (with a zero StatusCode) as soon as the first request
+// with a key comes in, which stops concurrent retries from running alongside
+// it. Once the handler is done the response gets saved into the record.
+type IdempotencyRecord struct {
+    Key         string
+    Fingerprint string
+    StatusCode  int
+    Body        []byte
+    CreatedAt   time.Time
+}
+
+func (r *IdempotencyRecord) Completed() bool {
+    return r.StatusCode != 0
+}
+
+// Checking whether a stored record should be treated as if it did not exist
+func (r *IdempotencyRecord) Expired(now time.Time) bool {
+    if now.Sub(r.CreatedAt) > idempotencyKeyTTL {
+        return true
+    }
+    return !r.Completed() && now.Sub(r.CreatedAt) > idempotencyLockTimeout
+}
+
+// The fingerprint ties a key to the request that it was first used with, so
+// that a client reusing a key for something else gets told off instead of
+// silently receiving the response of an unrelated request.
+func requestFingerprint(r *http.Request, body []byte) string {
+    h := sha256.New()
+    h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+    h.Write(body)
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// Keys are chosen by clients, so they are namespaced by the account that is
+// logged in. Otherwise one customer could replay (and read) the response of
+// another one just by guessing the key.
+func idempotencyScope(r *http.Request, key string) string {
+    if account, ok := authAccount(r); ok {
+        return strconv.FormatInt(account.Number, 10) + ":" + key
+    }
+    return "public:" + key
+}
+
+// A decorator function for POST handlers that must not run twice for the
+// same Idempotency-Key. Requests without the header go straight through.
+// For authenticated routes it has to sit inside withJWT so that the keys get
+// scoped to the account.
+func withIdempotency(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        ctx := r.Context()
+        key := r.Header.Get(idempotencyHeader)
+        if r.Method != "POST" || key == "" {
+            handlerFunc(w, r)
+            return
+        }
+        if len(key) > maxIdempotencyKeyLength {
+            writeError(w, r, errBadRequest("Idempotency-Key is too long"))
+            return
+        }
+
+        // The body is needed for the fingerprint, so it is read here and then
+        // put back for the actual handler to decode. One that is too large is
+        // turned away whole, a fingerprint of just the start of it would make
+        // two different requests look the same.
+        body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            writeError(w, r, ErrBodyTooLarge)
+            return
+        }
+        if err != nil {
+            writeError(w, r, errBadRequest("could not read request body"))
+            return
+        }
+        r.Body.Close()
+        r.Body = io.NopCloser(bytes.NewReader(body))
+
+        record := &IdempotencyRecord{
+            Key: idempotencyScope(r, key),
+            Fingerprint: requestFingerprint(r, body),
+            CreatedAt: time.Now().UTC(),
+        }
+        existing, err := s.ReserveIdempotencyKey(ctx, record)
+        if err != nil {
+            writeError(w, r, err)
+            return
+        }
+        if existing != nil {
+            replayIdempotentResponse(w, r, existing, record)
+            return
+        }
+
+        rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+        handlerFunc(rec, r)
+
+        // Server side failures are not stored so that the client can retry
+        // them, everything else (including a 422 for insufficient funds) is
+        // the final answer for this key. The handler has run by now, so this
+        // has to happen even if the client is already gone, otherwise the key
+        // would stay reserved until it expires.
+        ctx = context.WithoutCancel(ctx)
+        if rec.status >= http.StatusInternalServerError {
+            s.ReleaseIdempotencyKey(ctx, record.Key)
+            return
+        }
+        s.CompleteIdempotencyKey(ctx, record.Key, rec.status, rec.body.Bytes())
+    }
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, existing, incoming *IdempotencyRecord) {
+    if existing.Fingerprint != incoming.Fingerprint {
+        writeError(w, r, ErrIdempotencyKeyMismatch)
+        return
+    }
+    if !existing.Completed() {
+        writeError(w, r, ErrIdempotencyKeyInUse)
+        return
+    }
+    w.Header().Add("Content-Type", "application/json")
+    w.Header().Set(idempotencyReplayedHeader, "true")
+    w.WriteHeader(existing.StatusCode)
+    w.Write(existing.Body)
+}
+
+// responseRecorder passes everything through to the real ResponseWriter and
+// keeps a copy of the status and body so that they can be stored afterwards.
+type responseRecorder struct {
+    http.ResponseWriter
+    status      int
+    wroteHeader bool
+    body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+    if !rec.wroteHeader {
+        rec.status = status
+        rec.wroteHeader = true
+    }
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+    rec.wroteHeader = true
+    rec.body.Write(b)
+    return rec.ResponseWriter.Write(b)
+}
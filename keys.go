@@ -0,0 +1,256 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// -- SIGNING KEYS
+// Access tokens used to be signed with HS256 and a JWT_SECRET, which meant
+// that every service wanting to check a token needed the secret (and with it
+// the power to mint tokens), and an empty secret silently worked. Tokens are
+// now signed with a private key (RS256 or EdDSA) and anyone can verify them
+// with the public keys published at GET /.well-known/jwks.json.
+//
+// The keys are PEM files in one directory (JWT_KEYS_DIR), the file name
+// without .pem is the key ID (kid) which goes into the token header. Every key
+// in the directory is used for verifying, only the one named by
+// JWT_SIGNING_KEY signs new tokens. Rotating without logging anyone out:
+//
+//  1. add the new key to the directory everywhere, keep signing with the old
+//  2. switch JWT_SIGNING_KEY to the new key
+//  3. once the last tokens of the old key have expired (JWT_ACCESS_TTL),
+//     remove it
+//
+// A directory may also hold public keys only, e.g. of a retired key whose
+// private half has already been destroyed.
+
+const minRSAKeyBits = 2048
+
+type verificationKey struct {
+    kid    string
+    method jwt.SigningMethod
+    public crypto.PublicKey
+}
+
+type Keyring struct {
+    signingKID string
+    signer     crypto.Signer
+    keys       map[string]*verificationKey
+}
+
+// Reading the keyring from auth.keys_dir and auth.signing_key (JWT_KEYS_DIR
+// and JWT_SIGNING_KEY). There is no fallback: a server without keys must not
+// start.
+func LoadKeyringFromConfig(cfg AuthConfig) (*Keyring, error) {
+    if cfg.DevKeys {
+        return NewEphemeralKeyring()
+    }
+    if cfg.KeysDir == "" {
+        return nil, fmt.Errorf("auth.keys_dir (JWT_KEYS_DIR) is not set")
+    }
+    return LoadKeyring(cfg.KeysDir, cfg.SigningKey)
+}
+
+// Loading every *.pem file of a directory. If signingKID is empty the
+// directory has to hold exactly one private key, which then does the signing.
+func LoadKeyring(dir, signingKID string) (*Keyring, error) {
+    files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+    if err != nil {
+        return nil, err
+    }
+    if len(files) == 0 {
+        return nil, fmt.Errorf("no *.pem keys found in %s", dir)
+    }
+
+    kr := &Keyring{keys: map[string]*verificationKey{}}
+    signers := map[string]crypto.Signer{}
+    for _, file := range files {
+        kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+        data, err := os.ReadFile(file)
+        if err != nil {
+            return nil, err
+        }
+        signer, public, err := parseKeyPEM(data)
+        if err != nil {
+            return nil, fmt.Errorf("key %s: %w", file, err)
+        }
+        if err := kr.add(kid, public); err != nil {
+            return nil, fmt.Errorf("key %s: %w", file, err)
+        }
+        if signer != nil {
+            signers[kid] = signer
+        }
+    }
+
+    if signingKID == "" {
+        if len(signers) != 1 {
+            return nil, fmt.Errorf("%s holds %d private keys, set JWT_SIGNING_KEY to pick one", dir, len(signers))
+        }
+        for kid := range signers {
+            signingKID = kid
+        }
+    }
+    signer, ok := signers[signingKID]
+    if !ok {
+        return nil, fmt.Errorf("no private key %q in %s", signingKID, dir)
+    }
+    kr.signingKID, kr.signer = signingKID, signer
+    return kr, nil
+}
+
+// A keyring with a freshly generated Ed25519 key that only lives as long as
+// the process. Fine for tests and local development, every restart logs
+// everybody out.
+func NewEphemeralKeyring() (*Keyring, error) {
+    public, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    kid, err := randomToken(8)
+    if err != nil {
+        return nil, err
+    }
+    kr := &Keyring{keys: map[string]*verificationKey{}}
+    if err := kr.add(kid, public); err != nil {
+        return nil, err
+    }
+    kr.signingKID, kr.signer = kid, private
+    return kr, nil
+}
+
+// Private keys come as PKCS #8 ("PRIVATE KEY") or PKCS #1 ("RSA PRIVATE
+// KEY"), public keys as PKIX ("PUBLIC KEY"). The signer is nil for public keys.
+func parseKeyPEM(data []byte) (crypto.Signer, crypto.PublicKey, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, nil, fmt.Errorf("not a PEM file")
+    }
+    var key any
+    var err error
+    switch block.Type {
+    case "PRIVATE KEY":
+        key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    case "RSA PRIVATE KEY":
+        key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "PUBLIC KEY":
+        key, err = x509.ParsePKIXPublicKey(block.Bytes)
+    default:
+        return nil, nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+    if signer, ok := key.(crypto.Signer); ok {
+        return signer, signer.Public(), nil
+    }
+    return nil, key, nil
+}
+
+// Every key is tied to exactly one algorithm, a token claiming a different
+// one is rejected no matter what its signature says.
+func (kr *Keyring) add(kid string, public crypto.PublicKey) error {
+    var method jwt.SigningMethod
+    switch key := public.(type) {
+    case *rsa.PublicKey:
+        if key.N.BitLen() < minRSAKeyBits {
+            return fmt.Errorf("RSA keys need at least %d bits", minRSAKeyBits)
+        }
+        method = jwt.SigningMethodRS256
+    case ed25519.PublicKey:
+        method = jwt.SigningMethodEdDSA
+    default:
+        return fmt.Errorf("unsupported key type %T, expected RSA or Ed25519", public)
+    }
+    kr.keys[kid] = &verificationKey{kid: kid, method: method, public: public}
+    return nil
+}
+
+// Signing claims with the active key, its ID goes into the kid header
+func (kr *Keyring) Sign(claims jwt.Claims) (string, error) {
+    key := kr.keys[kr.signingKID]
+    token := jwt.NewWithClaims(key.method, claims)
+    token.Header["kid"] = kr.signingKID
+    return token.SignedString(kr.signer)
+}
+
+// Parsing and verifying an access token. Tokens without a kid, with an
+// unknown kid or with an algorithm that does not belong to their key (HS256
+// with the public key as the secret being the classic) are all rejected.
+func (kr *Keyring) Parse(tokenString string) (*jwt.Token, error) {
+    return jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+        kid, _ := token.Header["kid"].(string)
+        key, ok := kr.keys[kid]
+        if !ok {
+            return nil, fmt.Errorf("unknown signing key %q", kid)
+        }
+        if token.Method.Alg() != key.method.Alg() {
+            return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+        }
+        return key.public, nil
+    })
+}
+
+// -- JWKS
+// The public keys in the JSON Web Key Set format (RFC 7517), which is what
+// JWT libraries in other services know how to consume.
+
+type JWK struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    Alg string `json:"alg"`
+    // RSA
+    N string `json:"n,omitempty"`
+    E string `json:"e,omitempty"`
+    // Ed25519 (RFC 8037)
+    Crv string `json:"crv,omitempty"`
+    X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+    Keys []JWK `json:"keys"`
+}
+
+func (kr *Keyring) JWKS() *JWKSet {
+    set := &JWKSet{Keys: []JWK{}}
+    for _, key := range kr.keys {
+        jwk := JWK{Kid: key.kid, Use: "sig", Alg: key.method.Alg()}
+        switch public := key.public.(type) {
+        case *rsa.PublicKey:
+            jwk.Kty = "RSA"
+            jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+            jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+        case ed25519.PublicKey:
+            jwk.Kty = "OKP"
+            jwk.Crv = "Ed25519"
+            jwk.X = base64.RawURLEncoding.EncodeToString(public)
+        }
+        set.Keys = append(set.Keys, jwk)
+    }
+    // Map order is random, a stable order keeps caches and diffs happy
+    sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+    return set
+}
+
+// GET /.well-known/jwks.json
+// Public, other services fetch this to verify our tokens. Keys only change
+// on a restart, so it is fine for them to cache it for a while.
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+    w.Header().Set("Cache-Control", "public, max-age=300")
+    return WriteJSON(w, http.StatusOK, s.keys.JWKS())
+}
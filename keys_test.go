@@ -0,0 +1,133 @@
+package main
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "net/http"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    jwt "github.com/golang-jwt/jwt/v4"
+    "github.com/stretchr/testify/assert"
+)
+
+func writePEM(t *testing.T, dir, kid, blockType string, der []byte) {
+    data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+    assert.Nil(t, os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600))
+}
+
+func testClaims() *Claims {
+    now := time.Now()
+    return &Claims{
+        AccountNumber: 123456,
+        RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute))},
+    }
+}
+
+func TestKeyringRotation(t *testing.T){
+    dir := t.TempDir()
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    assert.Nil(t, err)
+    writePEM(t, dir, "old", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+    _, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+    assert.Nil(t, err)
+    der, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+    assert.Nil(t, err)
+    writePEM(t, dir, "new", "PRIVATE KEY", der)
+
+    // Two private keys and nobody said which one signs
+    _, err = LoadKeyring(dir, "")
+    assert.NotNil(t, err)
+    _, err = LoadKeyring(dir, "missing")
+    assert.NotNil(t, err)
+
+    old, err := LoadKeyring(dir, "old")
+    assert.Nil(t, err)
+    oldToken, err := old.Sign(testClaims())
+    assert.Nil(t, err)
+
+    // After switching to the new key, tokens of the old one keep working
+    current, err := LoadKeyring(dir, "new")
+    assert.Nil(t, err)
+    newToken, err := current.Sign(testClaims())
+    assert.Nil(t, err)
+    for _, tok := range []string{oldToken, newToken} {
+        token, err := current.Parse(tok)
+        assert.Nil(t, err)
+        assert.True(t, token.Valid)
+    }
+    token, _ := current.Parse(newToken)
+    assert.Equal(t, "new", token.Header["kid"])
+    assert.Equal(t, "EdDSA", token.Header["alg"])
+
+    // Until the old key is removed, or only its public half is left
+    der, err = x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+    assert.Nil(t, err)
+    writePEM(t, dir, "old", "PUBLIC KEY", der)
+    current, err = LoadKeyring(dir, "")
+    assert.Nil(t, err)
+    _, err = current.Parse(oldToken)
+    assert.Nil(t, err)
+    _, err = LoadKeyring(dir, "old")
+    assert.NotNil(t, err)
+
+    assert.Nil(t, os.Remove(filepath.Join(dir, "old.pem")))
+    current, err = LoadKeyring(dir, "")
+    assert.Nil(t, err)
+    _, err = current.Parse(oldToken)
+    assert.NotNil(t, err)
+
+    jwks := current.JWKS()
+    assert.Len(t, jwks.Keys, 1)
+    assert.Equal(t, "OKP", jwks.Keys[0].Kty)
+    assert.Equal(t, "new", jwks.Keys[0].Kid)
+}
+
+func TestKeyringRejectsForgedTokens(t *testing.T){
+    kr, err := NewEphemeralKeyring()
+    assert.Nil(t, err)
+
+    // The classic: HS256 with an empty secret (what the old code accepted)
+    // or with the public key as the secret
+    for _, secret := range [][]byte{{}, []byte(kr.keys[kr.signingKID].public.(ed25519.PublicKey))} {
+        token := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+        token.Header["kid"] = kr.signingKID
+        forged, err := token.SignedString(secret)
+        assert.Nil(t, err)
+        _, err = kr.Parse(forged)
+        assert.NotNil(t, err)
+    }
+
+    // Signed by a key that is not in the keyring
+    other, err := NewEphemeralKeyring()
+    assert.Nil(t, err)
+    tok, err := other.Sign(testClaims())
+    assert.Nil(t, err)
+    _, err = kr.Parse(tok)
+    assert.NotNil(t, err)
+
+    // Keys that are too weak do not load at all
+    dir := t.TempDir()
+    weak, err := rsa.GenerateKey(rand.Reader, 1024)
+    assert.Nil(t, err)
+    writePEM(t, dir, "weak", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(weak))
+    _, err = LoadKeyring(dir, "")
+    assert.NotNil(t, err)
+    _, err = LoadKeyring(t.TempDir(), "")
+    assert.NotNil(t, err)
+}
+
+func TestJWKSEndpoint(t *testing.T){
+    server, _, router := newTestServer()
+    jwks := new(JWKSet)
+    rr := doRequest(t, router, "GET", "/.well-known/jwks.json", "", nil, jwks)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Len(t, jwks.Keys, 1)
+    assert.Equal(t, server.keys.signingKID, jwks.Keys[0].Kid)
+    assert.Equal(t, "EdDSA", jwks.Keys[0].Alg)
+}
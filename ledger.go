@@ -0,0 +1,179 @@
+package main
+
+import (
+    "errors"
+    "time"
+)
+
+// -- DOUBLE ENTRY LEDGER
+// Every change to the balance of an account is recorded as a journal entry.
+// An entry is made up of two or more postings, each of which adds (credit) or
+// removes (debit) money from exactly one account. The postings of an entry
+// must always add up to zero, which means that money is never created or
+// destroyed, it only moves around. Account.Balance is just a cached copy of
+// the sum of all postings of that account and is updated in the same SQL
+// transaction as the postings themselves.
+
+// Kinds of journal entries
+const (
+    EntryTransfer   = "transfer"
+    EntryDeposit    = "deposit"
+    EntryWithdrawal = "withdrawal"
+)
+
+// Money that comes in from (or goes out to) the outside world has to be
+// booked against something for the entry to balance. System accounts do not
+// live in the account table, so they get negative IDs which can never clash
+// with a SERIAL id.
+const (
+    CashAccountID = -1
+)
+
+var (
+    ErrUnbalancedEntry = errors.New("journal entry postings do not add up to zero")
+    ErrEmptyEntry      = errors.New("journal entry needs at least two postings")
+    ErrZeroPosting     = errors.New("journal entry contains a zero amount posting")
+)
+
+type JournalEntry struct {
+    ID        int64      `json:"id"`
+    Kind      string     `json:"kind"`
+    CreatedAt time.Time  `json:"created_at"`
+    PostedAt  time.Time  `json:"posted_at"`
+    Postings  []*Posting `json:"postings"`
+    // Link in the hash chain of the ledger, see chain.go
+    Hash string `json:"hash,omitempty"`
+}
+
+// Posting amounts are signed, a positive amount increases the balance of the
+// account and a negative amount decreases it. BalanceAfter is the balance of
+// the account right after the posting was applied (always zero for system
+// accounts because we do not keep a cached balance for them).
+type Posting struct {
+    ID           int64 `json:"id"`
+    EntryID      int64 `json:"entry_id"`
+    AccountID    int   `json:"account_id"`
+    Amount       int64 `json:"amount"`
+    BalanceAfter int64 `json:"balance_after"`
+}
+
+func isSystemAccount(id int) bool {
+    return id < 0
+}
+
+// Check that an entry can be posted. This is the only place that decides what
+// a valid entry looks like, so every store has to call it before writing.
+func (e *JournalEntry) Validate() error {
+    if len(e.Postings) < 2 {
+        return ErrEmptyEntry
+    }
+    var sum int64
+    for _, p := range e.Postings {
+        if p.Amount == 0 {
+            return ErrZeroPosting
+        }
+        sum += p.Amount
+    }
+    if sum != 0 {
+        return ErrUnbalancedEntry
+    }
+    return nil
+}
+
+// Building the entries for the different kinds of money movement. Keeping
+// them in one place makes sure that a transfer looks the same no matter which
+// store ends up writing it.
+func newTransferEntry(fromID, toID int, amount int64) *JournalEntry {
+    return &JournalEntry{
+        Kind: EntryTransfer,
+        CreatedAt: time.Now().UTC(),
+        Postings: []*Posting{
+            {AccountID: fromID, Amount: -amount},
+            {AccountID: toID, Amount: amount},
+        },
+    }
+}
+
+func newDepositEntry(accountID int, amount int64) *JournalEntry {
+    return &JournalEntry{
+        Kind: EntryDeposit,
+        CreatedAt: time.Now().UTC(),
+        Postings: []*Posting{
+            {AccountID: CashAccountID, Amount: -amount},
+            {AccountID: accountID, Amount: amount},
+        },
+    }
+}
+
+func newWithdrawalEntry(accountID int, amount int64) *JournalEntry {
+    return &JournalEntry{
+        Kind: EntryWithdrawal,
+        CreatedAt: time.Now().UTC(),
+        Postings: []*Posting{
+            {AccountID: accountID, Amount: -amount},
+            {AccountID: CashAccountID, Amount: amount},
+        },
+    }
+}
+
+// applyPostings runs the postings of an entry against the (locked) accounts
+// that they touch. The balances in the map get updated as we go and every
+// posting remembers the balance it left behind. No customer account is ever
+// allowed to go below zero, system accounts have no such limit.
+func applyPostings(entry *JournalEntry, accounts map[int]*Account) error {
+    for _, p := range entry.Postings {
+        if isSystemAccount(p.AccountID) {
+            continue
+        }
+        acc, ok := accounts[p.AccountID]
+        if !ok {
+            return errAccountNotFound(p.AccountID)
+        }
+        if acc.Balance + p.Amount < 0 {
+            return ErrInsufficientFunds
+        }
+        acc.Balance += p.Amount
+        p.BalanceAfter = acc.Balance
+    }
+    return nil
+}
+
+// Turning a posted transfer entry back into the record that the API returns.
+// The first posting is always the debit and the second one the credit, see
+// newTransferEntry.
+func newTransfer(entry *JournalEntry, accounts map[int]*Account) *Transfer {
+    debit, credit := entry.Postings[0], entry.Postings[1]
+    return &Transfer{
+        ID: entry.ID,
+        FromAccount: accounts[debit.AccountID].Number,
+        ToAccount: accounts[credit.AccountID].Number,
+        Amount: credit.Amount,
+        FromBalance: debit.BalanceAfter,
+        ToBalance: credit.BalanceAfter,
+        CreatedAt: entry.CreatedAt,
+        PostedAt: entry.PostedAt,
+        Hash: entry.Hash,
+    }
+}
+
+// LedgerReport is what the store hands back when asked to prove that the
+// books are in order. Total is the sum of every posting ever made and has to
+// be zero, and every account balance has to match the sum of its postings.
+type LedgerReport struct {
+    Entries           int64             `json:"entries"`
+    Postings          int64             `json:"postings"`
+    Total             int64             `json:"total"`
+    UnbalancedEntries []int64           `json:"unbalanced_entries"`
+    Mismatches        []BalanceMismatch `json:"mismatches"`
+}
+
+type BalanceMismatch struct {
+    AccountID   int   `json:"account_id"`
+    Number      int64 `json:"number"`
+    Balance     int64 `json:"balance"`
+    PostingsSum int64 `json:"postings_sum"`
+}
+
+func (r *LedgerReport) Balanced() bool {
+    return r.Total == 0 && len(r.UnbalancedEntries) == 0 && len(r.Mismatches) == 0
+}
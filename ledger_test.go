@@ -0,0 +1,43 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestJournalEntryValidate(t *testing.T){
+    assert.Nil(t, newTransferEntry(1, 2, 50).Validate())
+    assert.Nil(t, newDepositEntry(1, 50).Validate())
+    assert.Nil(t, newWithdrawalEntry(1, 50).Validate())
+
+    entry := &JournalEntry{Postings: []*Posting{{AccountID: 1, Amount: 10}}}
+    assert.ErrorIs(t, entry.Validate(), ErrEmptyEntry)
+
+    entry.Postings = append(entry.Postings, &Posting{AccountID: 2, Amount: -5})
+    assert.ErrorIs(t, entry.Validate(), ErrUnbalancedEntry)
+
+    entry.Postings = append(entry.Postings, &Posting{AccountID: 3, Amount: 0})
+    assert.ErrorIs(t, entry.Validate(), ErrZeroPosting)
+}
+
+func TestApplyPostings(t *testing.T){
+    accounts := map[int]*Account{
+        1: {ID: 1, Number: 111111, Balance: 100},
+        2: {ID: 2, Number: 222222, Balance: 0},
+    }
+
+    entry := newTransferEntry(1, 2, 60)
+    assert.Nil(t, applyPostings(entry, accounts))
+    assert.Equal(t, int64(40), accounts[1].Balance)
+    assert.Equal(t, int64(60), accounts[2].Balance)
+
+    transfer := newTransfer(entry, accounts)
+    assert.Equal(t, int64(111111), transfer.FromAccount)
+    assert.Equal(t, int64(222222), transfer.ToAccount)
+    assert.Equal(t, int64(40), transfer.FromBalance)
+    assert.Equal(t, int64(60), transfer.ToBalance)
+
+    // Account 1 only has 40 left
+    assert.ErrorIs(t, applyPostings(newTransferEntry(1, 2, 41), accounts), ErrInsufficientFunds)
+}
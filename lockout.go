@@ -0,0 +1,254 @@
+package main
+
+import (
+    "context"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// -- LOGIN LOCKOUT
+// Account numbers only have six digits, so without any throttling guessing
+// passwords across accounts would be trivial. Failed logins are counted per
+// account number and per client IP. Once a counter reaches the threshold of
+// its policy it gets locked, first for BaseDelay and then twice as long with
+// every further failure up to MaxDelay. A locked account cannot log in even
+// with the right password until the lock runs out or an admin lifts it.
+//
+// Wrong TOTP codes count the same as wrong passwords, otherwise a stolen
+// password would allow guessing codes with an endless supply of challenges.
+// Every lock (and unlock) is recorded as a LockoutEvent so that support can
+// tell a customer why they cannot log in.
+
+type LockoutPolicy struct {
+    Threshold int
+    BaseDelay time.Duration
+    MaxDelay  time.Duration
+    // Failures are forgotten once there has not been one for this long
+    ResetAfter time.Duration
+}
+
+var (
+    accountLockoutPolicy = LockoutPolicy{
+        Threshold: 5,
+        BaseDelay: time.Minute,
+        MaxDelay: time.Hour,
+        ResetAfter: 24 * time.Hour,
+    }
+    // Several customers can share an IP (offices, mobile carriers), so IPs
+    // get a lot more slack than single accounts.
+    ipLockoutPolicy = LockoutPolicy{
+        Threshold: 20,
+        BaseDelay: time.Minute,
+        MaxDelay: time.Hour,
+        ResetAfter: 24 * time.Hour,
+    }
+)
+
+const (
+    LockoutScopeAccount = "account"
+    LockoutScopeIP      = "ip"
+
+    LockoutActionLocked   = "locked"
+    LockoutActionUnlocked = "unlocked"
+)
+
+var ErrLoginLocked = NewAPIError(http.StatusTooManyRequests, "login_locked",
+    "too many failed login attempts, try again later")
+
+// The failure counter of one account number or IP. Key is the scope and the
+// value, e.g. "account:532204" or "ip:192.0.2.1".
+type LoginThrottle struct {
+    Key           string
+    Failures      int
+    LastFailureAt *time.Time
+    LockedUntil   *time.Time
+}
+
+func (t *LoginThrottle) Locked(now time.Time) bool {
+    return t.LockedUntil != nil && now.Before(*t.LockedUntil)
+}
+
+type LockoutEvent struct {
+    ID            int64      `json:"id"`
+    Scope         string     `json:"scope"`
+    Action        string     `json:"action"`
+    AccountNumber int64      `json:"account_number"`
+    IP            string     `json:"ip,omitempty"`
+    Failures      int        `json:"failures,omitempty"`
+    LockedUntil   *time.Time `json:"locked_until,omitempty"`
+    // The admin who lifted the lock
+    ActorNumber *int64    `json:"actor_number,omitempty"`
+    CreatedAt   time.Time `json:"created_at"`
+}
+
+func throttleKey(scope, value string) string {
+    return scope + ":" + value
+}
+
+// Counting one more failure, shared by every store. Returns whether this
+// failure locked the counter.
+func applyLoginFailure(t *LoginThrottle, p LockoutPolicy, now time.Time) bool {
+    if t.LastFailureAt != nil && now.Sub(*t.LastFailureAt) > p.ResetAfter {
+        t.Failures = 0
+        t.LockedUntil = nil
+    }
+    t.Failures++
+    last := now
+    t.LastFailureAt = &last
+    if t.Failures < p.Threshold {
+        return false
+    }
+    delay := p.MaxDelay
+    // Beyond a few doublings the delay is way past any sensible maximum, the
+    // cap on the shift keeps it from overflowing.
+    if shift := t.Failures - p.Threshold; shift < 32 {
+        if d := p.BaseDelay << shift; d < p.MaxDelay {
+            delay = d
+        }
+    }
+    until := now.Add(delay)
+    t.LockedUntil = &until
+    return true
+}
+
+// The address the request came from. There is no proxy in front of us, so
+// X-Forwarded-For would only be something that clients can make up.
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// Rejecting the login right away if either the account number or the IP is
+// locked, telling the client when it is worth trying again.
+func (s *APIServer) checkLoginLockout(w http.ResponseWriter, r *http.Request, number int64) error {
+    ctx := r.Context()
+    now := time.Now().UTC()
+    var until time.Time
+    for _, key := range []string{
+        throttleKey(LockoutScopeAccount, strconv.FormatInt(number, 10)),
+        throttleKey(LockoutScopeIP, clientIP(r)),
+    } {
+        t, err := s.store.GetLoginThrottle(ctx, key)
+        if err != nil {
+            return err
+        }
+        if t.Locked(now) && t.LockedUntil.After(until) {
+            until = *t.LockedUntil
+        }
+    }
+    if until.IsZero() {
+        return nil
+    }
+    retry := int(math.Ceil(until.Sub(now).Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(retry))
+    return ErrLoginLocked
+}
+
+// Counting a failed login against the account number and the IP. Unknown
+// account numbers are counted as well, so that a locked out number does not
+// tell anyone whether the account exists.
+//
+// A client that hangs up right after a wrong password must not get out of
+// having it counted, so this does not stop when the request is cancelled.
+func (s *APIServer) recordLoginFailure(r *http.Request, number int64) error {
+    ctx := context.WithoutCancel(r.Context())
+    now := time.Now().UTC()
+    ip := clientIP(r)
+    for _, c := range []struct {
+        scope, value string
+        policy       LockoutPolicy
+    }{
+        {LockoutScopeAccount, strconv.FormatInt(number, 10), accountLockoutPolicy},
+        {LockoutScopeIP, ip, ipLockoutPolicy},
+    } {
+        t, locked, err := s.store.RecordLoginFailure(ctx, throttleKey(c.scope, c.value), c.policy, now)
+        if err != nil {
+            return err
+        }
+        if !locked {
+            continue
+        }
+        s.audit(r, auditEvent{Action: AuditLoginLocked, Target: number, After: map[string]any{
+            "scope": c.scope,
+            "failures": t.Failures,
+            "locked_until": t.LockedUntil,
+        }})
+        err = s.store.CreateLockoutEvent(ctx, &LockoutEvent{
+            Scope: c.scope,
+            Action: LockoutActionLocked,
+            AccountNumber: number,
+            IP: ip,
+            Failures: t.Failures,
+            LockedUntil: t.LockedUntil,
+            CreatedAt: now,
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// A successful login wipes the slate of the account, but not of the IP: an
+// attacker with one working account must not be able to reset their IP
+// counter with it.
+func (s *APIServer) clearLoginFailures(ctx context.Context, number int64) error {
+    return s.store.ResetLoginThrottle(ctx, throttleKey(LockoutScopeAccount, strconv.FormatInt(number, 10)))
+}
+
+// POST /account/{id}/unlock
+// Lifting the lock of an account (and forgetting its failed logins) for a
+// customer that has convinced support that it really is them.
+func (s *APIServer) handleUnlockAccount(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    id, err := getID(r)
+    if err != nil {
+        return err
+    }
+    account, err := s.store.GetAccountByID(ctx, id)
+    if err != nil {
+        return err
+    }
+    if err := s.clearLoginFailures(ctx, account.Number); err != nil {
+        return err
+    }
+    admin, _ := authAccount(r)
+    err = s.store.CreateLockoutEvent(ctx, &LockoutEvent{
+        Scope: LockoutScopeAccount,
+        Action: LockoutActionUnlocked,
+        AccountNumber: account.Number,
+        IP: clientIP(r),
+        ActorNumber: &admin.Number,
+        CreatedAt: time.Now().UTC(),
+    })
+    if err != nil {
+        return err
+    }
+    s.audit(r, auditEvent{Action: AuditAccountUnlocked, Target: account.Number})
+    return WriteJSON(w, http.StatusOK, map[string]int{"unlocked": id})
+}
+
+// GET /account/{id}/lockouts
+// Every lock and unlock that involved the account number, newest first
+func (s *APIServer) handleGetLockouts(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    id, err := getID(r)
+    if err != nil {
+        return err
+    }
+    account, err := s.store.GetAccountByID(ctx, id)
+    if err != nil {
+        return err
+    }
+    events, err := s.store.GetLockoutEvents(ctx, account.Number)
+    if err != nil {
+        return err
+    }
+    return WriteJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestApplyLoginFailure(t *testing.T){
+    p := LockoutPolicy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: 5 * time.Minute, ResetAfter: time.Hour}
+    now := time.Now()
+    th := &LoginThrottle{}
+
+    assert.False(t, applyLoginFailure(th, p, now))
+    assert.False(t, applyLoginFailure(th, p, now))
+    assert.False(t, th.Locked(now))
+
+    // 1, 2, 4 minutes, and then never more than the maximum
+    for _, want := range []time.Duration{1, 2, 4, 5, 5} {
+        assert.True(t, applyLoginFailure(th, p, now))
+        assert.Equal(t, now.Add(want*time.Minute), *th.LockedUntil)
+    }
+    assert.True(t, th.Locked(now))
+    assert.False(t, th.Locked(now.Add(5*time.Minute)))
+
+    // A long quiet period starts over
+    later := now.Add(2 * time.Hour)
+    assert.False(t, applyLoginFailure(th, p, later))
+    assert.Equal(t, 1, th.Failures)
+    assert.False(t, th.Locked(later))
+
+    // Failures that have been going on for ages do not overflow the delay
+    th.Failures = 1000
+    assert.True(t, applyLoginFailure(th, p, later))
+    assert.Equal(t, later.Add(p.MaxDelay), *th.LockedUntil)
+}
+
+func TestLoginLockout(t *testing.T){
+    server, store, router := newTestServer()
+    acc, err := NewAccount("a", "b", "hello123")
+    assert.Nil(t, err)
+    assert.Nil(t, store.CreateAccount(ctx, acc))
+    admin := newTestAccount(t, store, 999999, 0)
+    store.UpdateAccountRole(ctx, admin.ID, RoleAdmin)
+    admin.Role = RoleAdmin
+    adminToken := loginAs(t, server, admin).Token
+
+    wrong := &LoginRequest{Number: acc.Number, Password: "wrong"}
+    right := &LoginRequest{Number: acc.Number, Password: "hello123"}
+    for i := 0; i < accountLockoutPolicy.Threshold; i++ {
+        rr := doRequest(t, router, "POST", "/login", "", wrong, nil)
+        assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    }
+
+    // Locked, even with the right password
+    apiErr := new(APIError)
+    rr := doRequest(t, router, "POST", "/login", "", right, apiErr)
+    assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+    assert.Equal(t, "login_locked", apiErr.Code)
+    assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+    // Support can see what happened, only an admin can undo it
+    events := []*LockoutEvent{}
+    rr = doRequest(t, router, "GET", "/account/1/lockouts", adminToken, nil, &events)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Len(t, events, 1)
+    assert.Equal(t, LockoutActionLocked, events[0].Action)
+    assert.Equal(t, accountLockoutPolicy.Threshold, events[0].Failures)
+    assert.Equal(t, "192.0.2.1", events[0].IP)
+
+    customerToken := loginAs(t, server, acc).Token
+    rr = doRequest(t, router, "POST", "/account/1/unlock", customerToken, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr = doRequest(t, router, "POST", "/account/1/unlock", adminToken, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    rr = doRequest(t, router, "POST", "/login", "", right, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+
+    events = []*LockoutEvent{}
+    doRequest(t, router, "GET", "/account/1/lockouts", adminToken, nil, &events)
+    assert.Len(t, events, 2)
+    assert.Equal(t, LockoutActionUnlocked, events[0].Action)
+    assert.Equal(t, admin.Number, *events[0].ActorNumber)
+}
+
+func TestLoginLockoutPerIP(t *testing.T){
+    _, _, router := newTestServer()
+
+    // Spraying guesses over many account numbers, which may not even exist
+    for i := 0; i < ipLockoutPolicy.Threshold; i++ {
+        rr := doRequest(t, router, "POST", "/login", "", &LoginRequest{Number: int64(100000 + i), Password: "guess"}, nil)
+        assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    }
+    rr := doRequest(t, router, "POST", "/login", "", &LoginRequest{Number: 555555, Password: "guess"}, nil)
+    assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+}
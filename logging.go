@@ -0,0 +1,138 @@
+package main
+
+import (
+    "context"
+    "io"
+    "log/slog"
+    "net/http"
+    "time"
+
+    semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// -- LOGGING
+// Logs are written with log/slog, as JSON by default so that they can be
+// shipped somewhere and searched. Every request gets exactly one access log
+// line once it is done:
+//
+//     {"level":"INFO","msg":"request","request_id":"...","method":"POST",
+//      "route":"/transfer","status":422,"latency_ms":3.1,"account":123456,
+//      "error_code":"insufficient_funds","ip":"192.0.2.1"}
+//
+// The logger of a request (already carrying its request_id) travels in the
+// request context, so handlers and stores can log with loggerFrom(ctx) and
+// their lines can be matched up with the access log.
+
+const (
+    LogFormatJSON = "json"
+    LogFormatText = "text"
+)
+
+type LogConfig struct {
+    Level  slog.Level `json:"level" yaml:"level"`
+    // json, or text which is easier on the eyes during development
+    Format string `json:"format" yaml:"format"`
+}
+
+func NewLogger(w io.Writer, cfg LogConfig) *slog.Logger {
+    opts := &slog.HandlerOptions{Level: cfg.Level}
+    if cfg.Format == LogFormatText {
+        return slog.New(slog.NewTextHandler(w, opts))
+    }
+    return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+const (
+    loggerKey     contextKey = "logger"
+    requestLogKey contextKey = "requestLog"
+)
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+    return context.WithValue(ctx, loggerKey, logger)
+}
+
+// The logger of the request that ctx belongs to, or the default one for
+// anything that does not run as part of a request (startup, the CLI).
+func loggerFrom(ctx context.Context) *slog.Logger {
+    if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+        return logger
+    }
+    return slog.Default()
+}
+
+// What the access log needs to know but only finds out on the way down:
+// the route is matched by the router and the account by withJWT, both of
+// which hand a new request to the next handler, and the error code only
+// exists inside writeError. They note it down here.
+type requestLog struct {
+    route     string
+    account   int64
+    errorCode string
+}
+
+func currentRequestLog(r *http.Request) *requestLog {
+    if info, ok := r.Context().Value(requestLogKey).(*requestLog); ok {
+        return info
+    }
+    // Outside of withAccessLog (tests calling a handler directly)
+    return new(requestLog)
+}
+
+func noteAccount(r *http.Request, number int64) {
+    currentRequestLog(r).account = number
+}
+
+func noteErrorCode(r *http.Request, code string) {
+    currentRequestLog(r).errorCode = code
+}
+
+// Registered with router.Use() so that it runs once a route has matched
+func noteRoute(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route := routeTemplate(r)
+        currentRequestLog(r).route = route
+        span := trace.SpanFromContext(r.Context())
+        span.SetName(r.Method + " " + route)
+        span.SetAttributes(semconv.HTTPRoute(route))
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Sits outside of the router (see Router()) so that requests which match no
+// route at all are logged as well. It has to run inside withRequestID.
+func (s *APIServer) withAccessLog(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        logger := s.logger.With("request_id", requestID(r))
+        // Linking the logs of a request with its trace
+        if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+            logger = logger.With("trace_id", sc.TraceID().String())
+        }
+        info := &requestLog{route: "unmatched"}
+        ctx := withLogger(r.Context(), logger)
+        ctx = context.WithValue(ctx, requestLogKey, info)
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r.WithContext(ctx))
+
+        status := rec.Status()
+        attrs := []slog.Attr{
+            slog.String("method", r.Method),
+            slog.String("route", info.route),
+            slog.Int("status", status),
+            slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+            slog.String("ip", clientIP(r)),
+        }
+        if info.account != 0 {
+            attrs = append(attrs, slog.Int64("account", info.account))
+        }
+        if info.errorCode != "" {
+            attrs = append(attrs, slog.String("error_code", info.errorCode))
+        }
+        level := slog.LevelInfo
+        if status >= http.StatusInternalServerError {
+            level = slog.LevelError
+        }
+        logger.LogAttrs(ctx, level, "request", attrs...)
+    })
+}
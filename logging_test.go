@@ -0,0 +1,96 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func readLogLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+    lines := []map[string]any{}
+    dec := json.NewDecoder(buf)
+    for dec.More() {
+        line := map[string]any{}
+        assert.Nil(t, dec.Decode(&line))
+        lines = append(lines, line)
+    }
+    return lines
+}
+
+func TestAccessLog(t *testing.T){
+    server, store, _ := newTestServer()
+    var buf bytes.Buffer
+    server.logger = NewLogger(&buf, LogConfig{Format: LogFormatJSON})
+    router := server.Router()
+    from := newTestAccount(t, store, 111111, 10)
+    to := newTestAccount(t, store, 222222, 0)
+    token := loginAs(t, server, from).Token
+
+    req := httptest.NewRequest("POST", "/transfer", bytes.NewBufferString(`{"to_account": 222222, "amount": 50}`))
+    req.Header.Set("x-jwt-token", token)
+    req.Header.Set(requestIDHeader, "req-log-1")
+    rr := httptest.NewRecorder()
+    router.ServeHTTP(rr, req)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    doRequest(t, router, "GET", "/nowhere", "", nil, nil)
+    rr = doRequest(t, router, "GET", fmt.Sprintf("/account/%d", to.ID), token, nil, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+
+    lines := readLogLines(t, &buf)
+    assert.Len(t, lines, 3)
+    line := lines[0]
+    assert.Equal(t, "request", line["msg"])
+    assert.Equal(t, "req-log-1", line["request_id"])
+    assert.Equal(t, "POST", line["method"])
+    assert.Equal(t, "/transfer", line["route"])
+    assert.Equal(t, float64(http.StatusUnprocessableEntity), line["status"])
+    assert.Equal(t, float64(111111), line["account"])
+    assert.Equal(t, "insufficient_funds", line["error_code"])
+    assert.Contains(t, line, "latency_ms")
+
+    // Requests that match no route are logged too, without an account
+    line = lines[1]
+    assert.Equal(t, "unmatched", line["route"])
+    assert.Equal(t, float64(http.StatusNotFound), line["status"])
+    assert.NotContains(t, line, "account")
+    assert.NotEmpty(t, line["request_id"])
+
+    // Turned away by the authz middleware before reaching the handler
+    line = lines[2]
+    assert.Equal(t, "/account/{id}", line["route"])
+    assert.Equal(t, float64(http.StatusForbidden), line["status"])
+    assert.Equal(t, "permission_denied", line["error_code"])
+}
+
+func TestRequestLogger(t *testing.T){
+    store := slowStore{NewMemoryStore()}
+    acc := newTestAccount(t, store, 123456, 0)
+    keys, _ := NewEphemeralKeyring()
+    server := NewAPIServer(":0", store, keys)
+    var buf bytes.Buffer
+    server.logger = NewLogger(&buf, LogConfig{Format: LogFormatJSON})
+    token := loginAs(t, server, acc).Token
+
+    req := httptest.NewRequest("GET", "/account/1/transactions", nil)
+    req.Header.Set("x-jwt-token", token)
+    req.Header.Set(requestIDHeader, "req-log-2")
+    server.Router().ServeHTTP(httptest.NewRecorder(), req)
+
+    // What the handler logged can be matched up with the access log
+    lines := readLogLines(t, &buf)
+    assert.Len(t, lines, 2)
+    assert.Equal(t, "request failed", lines[0]["msg"])
+    assert.Equal(t, "ERROR", lines[0]["level"])
+    assert.Contains(t, lines[0]["error"], "deadline exceeded")
+    assert.Equal(t, "request", lines[1]["msg"])
+    assert.Equal(t, "ERROR", lines[1]["level"])
+    assert.Equal(t, "timeout", lines[1]["error_code"])
+    for _, line := range lines {
+        assert.Equal(t, "req-log-2", line["request_id"])
+    }
+}
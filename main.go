@@ -1,46 +1,253 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
-func seedAccount(store Storage, fname, lname, pw string) (*Account) {
+func seedAccount(ctx context.Context, store Storage, fname, lname, pw string) (*Account) {
     acc, err := NewAccount(fname, lname, pw)
     if err != nil {
         log.Fatal(err)
     }
-    if err := store.CreateAccount(acc); err != nil {
+    if err := store.CreateAccount(ctx, acc); err != nil {
         log.Fatal(err)
     }
 
     return acc
 }
 
-func seedAccounts(s Storage) {
-    seedAccount(s, "Ritesh", "Koushik", "hello123")
+func seedAccounts(ctx context.Context, s Storage) {
+    acc := seedAccount(ctx, s, "Ritesh", "Koushik", "hello123")
+
+    // Staff accounts can only be promoted by an admin, so somebody has to be 
+    // the first one. Its password is drawn here and printed this one time, a
+    // fixed one would be an admin login that every seeded deployment shares.
+    password, err := randomToken(18)
+    if err != nil {
+        log.Fatal(err)
+    }
+    admin := seedAccount(ctx, s, "Admin", "Admin", password)
+    if _, err := s.UpdateAccountRole(ctx, admin.ID, RoleAdmin); err != nil {
+        log.Fatal(err)
+    }
+    fmt.Printf("Admin account %d, password %s (it is not shown again)\n", admin.Number, password)
+
+    // Money can only show up in an account through the ledger, so the seed
+    // account gets its opening balance as a deposit.
+    if _, err := s.Deposit(ctx, acc.ID, 10000); err != nil {
+        log.Fatal(err)
+    }
+}
+
+// Printing the ledger report and telling the caller whether the books add up
+func checkLedger(ctx context.Context, s Storage) bool {
+    report, err := s.CheckLedger(ctx)
+    if err != nil {
+        log.Fatal(err)
+    }
+    out, _ := json.MarshalIndent(report, "", "  ")
+    fmt.Println(string(out))
+    return report.Balanced()
+}
+
+// Walking the hash chains of the ledger and the audit log, same as GET /verify
+func verify(ctx context.Context, s Storage) bool {
+    report, err := verifyChains(ctx, s)
+    if err != nil {
+        log.Fatal(err)
+    }
+    out, _ := json.MarshalIndent(report, "", "  ")
+    fmt.Println(string(out))
+    return report.Intact
+}
+
+// Picking the storage backend. The in-memory store needs no setup at all and
+// forgets everything on exit, which is handy for local development.
+func newStorage(cfg *Config) (Storage, error) {
+    switch cfg.Store {
+    case "memory":
+        return NewMemoryStore(), nil
+    case "postgres":
+        store, err := NewPostgresStore(cfg.Database)
+        if err != nil {
+            return nil, err
+        }
+        if err := store.Init(); err != nil {
+            return nil, err
+        }
+        return store, nil
+    }
+    return nil, fmt.Errorf("unknown store %q, expected postgres or memory", cfg.Store)
+}
+
+func loadKeyring(cfg AuthConfig) (*Keyring, error) {
+    if cfg.DevKeys {
+        log.Println("signing tokens with a throwaway key, they stop working on restart")
+    }
+    return LoadKeyringFromConfig(cfg)
+}
+
+// go-bank migrate [up | down [steps] | status]
+// Running the schema migrations by hand. The server also applies pending
+// migrations on startup, so this is mostly useful for rolling back and for
+// checking where a database stands.
+func runMigrate(cfg *Config, args []string) error {
+    store, err := NewPostgresStore(cfg.Database)
+    if err != nil {
+        return err
+    }
+    defer store.Close()
+    migrator, err := NewMigrator(store.db)
+    if err != nil {
+        return err
+    }
+
+    cmd := "up"
+    if len(args) > 0 {
+        cmd = args[0]
+    }
+    switch cmd {
+    case "up":
+        applied, err := migrator.Up()
+        for _, m := range applied {
+            fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+        }
+        if err == nil && len(applied) == 0 {
+            fmt.Println("nothing to migrate")
+        }
+        return err
+    case "down":
+        // Only the last migration is rolled back unless told otherwise, 
+        // rolling back everything by accident would be a disaster.
+        steps := 1
+        if len(args) > 1 {
+            steps, err = strconv.Atoi(args[1])
+            if err != nil || steps < 1 {
+                return fmt.Errorf("invalid number of steps %s", args[1])
+            }
+        }
+        reverted, err := migrator.Down(steps)
+        for _, m := range reverted {
+            fmt.Printf("rolled back %04d_%s\n", m.Version, m.Name)
+        }
+        return err
+    case "status":
+        statuses, err := migrator.Status()
+        if err != nil {
+            return err
+        }
+        for _, st := range statuses {
+            applied := "pending"
+            if st.AppliedAt != nil {
+                applied = st.AppliedAt.Format(time.RFC3339)
+            }
+            fmt.Printf("%04d_%-30s %s\n", st.Version, st.Name, applied)
+        }
+        return nil
+    }
+    return fmt.Errorf("unknown migrate command %q, expected up, down or status", cmd)
 }
 
 func main() {
     // This allows you to create command line flags just like CLI apps
     seed := flag.Bool("seed", false, "seed the DB")
+    ledger := flag.Bool("check-ledger", false, "check that the ledger is balanced and exit")
+    configFlags := RegisterConfigFlags(flag.CommandLine)
     flag.Parse()
 
-    store, err := NewPostgresStore()
-    if err != nil {
+    if err := loadDotEnv(); err != nil {
         log.Fatal(err)
     }
-    if err := store.Init(); err != nil {
+    cfg, err := LoadConfig(configFlags, os.Getenv)
+    if err != nil {
+        log.Fatalf("invalid configuration:\n%v", err)
+    }
+    // Everything that still goes through the log package ends up in the
+    // same structured output
+    logger := NewLogger(os.Stderr, cfg.Log)
+    slog.SetDefault(logger)
+
+    if flag.Arg(0) == "migrate" {
+        if err := runMigrate(cfg, flag.Args()[1:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    store, err := newStorage(cfg)
+    if err != nil {
         log.Fatal(err)
     }
 
+    if *ledger {
+        if !checkLedger(context.Background(), store) {
+            os.Exit(1)
+        }
+        return
+    }
+    // go-bank verify
+    if flag.Arg(0) == "verify" {
+        if !verify(context.Background(), store) {
+            os.Exit(1)
+        }
+        return
+    }
+
 	// seed stuff
     if *seed {
         fmt.Println("Seeding the database")
-        seedAccounts(store)
+        seedAccounts(context.Background(), store)
+    }
+
+    keys, err := loadKeyring(cfg.Auth)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    shutdownTracing, err := SetupTracing(context.Background(), cfg.Tracing)
+    if err != nil {
+        log.Fatal(err)
     }
 
-	server := NewAPIServer(":3000", store)
-	server.Run()
+	server := NewAPIServer(cfg.ListenAddr, store, keys)
+    server.tokens = cfg.Auth.TokenConfig()
+    server.notifier = NewNotifier(cfg.NotifyFile)
+    server.features = cfg.Features
+    server.serverConfig = cfg.Server
+    server.logger = logger
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    go func() {
+        // After the first signal the default behaviour is back, so a second 
+        // one kills the server right away instead of waiting for the drain.
+        <-ctx.Done()
+        stop()
+    }()
+    runErr := server.Run(ctx)
+
+    // Only once no request can use it anymore
+    if err := store.Close(); err != nil {
+        logger.Error("closing the store failed", "error", err)
+    }
+    // Sending off the spans that are still buffered
+    flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := shutdownTracing(flushCtx); err != nil {
+        logger.Error("flushing traces failed", "error", err)
+    }
+    if runErr != nil {
+        logger.Error("server stopped", "error", runErr)
+        os.Exit(1)
+    }
+    logger.Info("server stopped")
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/collectors"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// -- METRICS
+// Everything is exposed at GET /metrics in the Prometheus text format:
+// request counts and latencies per route, the state of the database pool and
+// a few business counters. Every server has a registry of its own instead of
+// the global one, so that the tests can create as many servers as they like.
+//
+// Routes are labelled with their template (/account/{id}), never with the
+// actual path, otherwise every account ID would become a time series of its
+// own.
+
+const metricsNamespace = "go_bank"
+
+type Metrics struct {
+    registry *prometheus.Registry
+
+    requests        *prometheus.CounterVec
+    requestDuration *prometheus.HistogramVec
+    transfers       prometheus.Counter
+    transferVolume  prometheus.Counter
+    failedLogins    *prometheus.CounterVec
+}
+
+func NewMetrics(store Storage) *Metrics {
+    m := &Metrics{
+        registry: prometheus.NewRegistry(),
+        requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: metricsNamespace,
+            Name: "http_requests_total",
+            Help: "HTTP requests by route, method and status code.",
+        }, []string{"route", "method", "status"}),
+        requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Namespace: metricsNamespace,
+            Name: "http_request_duration_seconds",
+            Help: "HTTP request latencies by route and method.",
+            // Password hashing alone takes a good part of a second
+            Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+        }, []string{"route", "method"}),
+        transfers: prometheus.NewCounter(prometheus.CounterOpts{
+            Namespace: metricsNamespace,
+            Name: "transfers_total",
+            Help: "Transfers that were posted.",
+        }),
+        transferVolume: prometheus.NewCounter(prometheus.CounterOpts{
+            Namespace: metricsNamespace,
+            Name: "transfer_volume_total",
+            Help: "Sum of the amounts of all posted transfers.",
+        }),
+        failedLogins: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: metricsNamespace,
+            Name: "failed_logins_total",
+            Help: "Failed logins by the factor that was wrong (password or totp).",
+        }, []string{"factor"}),
+    }
+    m.registry.MustRegister(
+        m.requests,
+        m.requestDuration,
+        m.transfers,
+        m.transferVolume,
+        m.failedLogins,
+        collectors.NewGoCollector(),
+        collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+    )
+    // Open, idle and in use connections, waits for a free one and so on,
+    // straight from db.Stats(). The memory store has no pool to speak of.
+    if pg, ok := store.(*PostgresStore); ok {
+        m.registry.MustRegister(collectors.NewDBStatsCollector(pg.db, "go_bank"))
+    }
+    return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Counting and timing every request that matched a route. Unmatched ones
+// (404, 405) never get here, the router answers them before any middleware.
+func (m *Metrics) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r)
+
+        route := routeTemplate(r)
+        m.requests.WithLabelValues(route, r.Method, strconv.Itoa(rec.Status())).Inc()
+        m.requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+    })
+}
+
+func (m *Metrics) transferPosted(t *Transfer) {
+    m.transfers.Inc()
+    m.transferVolume.Add(float64(t.Amount))
+}
+
+func (m *Metrics) loginFailed(factor string) {
+    m.failedLogins.WithLabelValues(factor).Inc()
+}
+
+func routeTemplate(r *http.Request) string {
+    if route := mux.CurrentRoute(r); route != nil {
+        if tpl, err := route.GetPathTemplate(); err == nil {
+            return tpl
+        }
+    }
+    return "unmatched"
+}
+
+// statusRecorder remembers the status code a handler sent. Handlers that
+// only ever call Write send a 200.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+    if rec.status == 0 {
+        rec.status = status
+    }
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+    if rec.status == 0 {
+        rec.status = http.StatusOK
+    }
+    return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Status() int {
+    if rec.status == 0 {
+        return http.StatusOK
+    }
+    return rec.status
+}
+
+// Streaming responses (the audit export) need to get at the Flusher of the
+// real ResponseWriter.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T){
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    newTestAccount(t, store, 222222, 0)
+    token := loginAs(t, server, from).Token
+
+    doRequest(t, router, "POST", "/transfer", token, TransferRequest{ToAccount: 222222, Amount: 40}, nil)
+    doRequest(t, router, "POST", "/transfer", token, TransferRequest{ToAccount: 222222, Amount: 2}, nil)
+    doRequest(t, router, "POST", "/transfer", token, TransferRequest{ToAccount: 222222, Amount: 1000}, nil)
+    doRequest(t, router, "GET", "/account/1", token, nil, nil)
+    doRequest(t, router, "POST", "/login", "", &LoginRequest{Number: 111111, Password: "wrong"}, nil)
+
+    rr := doRequest(t, router, "GET", "/metrics", "", nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    body := rr.Body.String()
+    assert.Contains(t, body, `go_bank_http_requests_total{method="POST",route="/transfer",status="200"} 2`)
+    assert.Contains(t, body, `go_bank_http_requests_total{method="POST",route="/transfer",status="422"} 1`)
+    // Labelled with the route template, not the path
+    assert.Contains(t, body, `go_bank_http_requests_total{method="GET",route="/account/{id}",status="200"} 1`)
+    assert.Contains(t, body, `go_bank_http_request_duration_seconds_count{method="POST",route="/transfer"} 3`)
+    assert.Contains(t, body, "go_bank_transfers_total 2")
+    assert.Contains(t, body, "go_bank_transfer_volume_total 42")
+    assert.Contains(t, body, `go_bank_failed_logins_total{factor="password"} 1`)
+
+    server.features.Metrics = false
+    rr = doRequest(t, server.Router(), "GET", "/metrics", "", nil, nil)
+    assert.Equal(t, http.StatusNotFound, rr.Code)
+}
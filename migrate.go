@@ -0,0 +1,287 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "embed"
+    "errors"
+    "fmt"
+    "io/fs"
+    "path"
+    "regexp"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// -- SCHEMA MIGRATIONS
+// The schema lives in migrations/ as pairs of plain SQL files named
+// NNNN_description.up.sql and NNNN_description.down.sql. They are embedded
+// into the binary so that a deployment never has to ship them separately.
+// Applied versions are recorded in the schema_migrations table and every run
+// holds a PostgreSQL advisory lock, so two instances that start at the same
+// time cannot both try to apply the same migration.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary, but it has to be the same for every instance of go-bank
+const migrationLockID = 727_180_512
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+    Version int
+    Name    string
+    Up      string
+    Down    string
+}
+
+type MigrationStatus struct {
+    Version   int        `json:"version"`
+    Name      string     `json:"name"`
+    AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Reading the embedded migrations and making sure that they form an unbroken
+// sequence starting at 1, each with both an up and a down file.
+func loadMigrations(files fs.FS) ([]*Migration, error) {
+    names, err := fs.Glob(files, "migrations/*.sql")
+    if err != nil {
+        return nil, err
+    }
+    byVersion := map[int]*Migration{}
+    for _, name := range names {
+        match := migrationFileName.FindStringSubmatch(path.Base(name))
+        if match == nil {
+            return nil, fmt.Errorf("badly named migration file %s", name)
+        }
+        version, _ := strconv.Atoi(match[1])
+        body, err := fs.ReadFile(files, name)
+        if err != nil {
+            return nil, err
+        }
+        m, ok := byVersion[version]
+        if !ok {
+            m = &Migration{Version: version, Name: match[2]}
+            byVersion[version] = m
+        }
+        if m.Name != match[2] {
+            return nil, fmt.Errorf("migration %d has two different names: %s and %s", version, m.Name, match[2])
+        }
+        if match[3] == "up" {
+            m.Up = string(body)
+        } else {
+            m.Down = string(body)
+        }
+    }
+
+    migrations := []*Migration{}
+    for _, m := range byVersion {
+        migrations = append(migrations, m)
+    }
+    sort.Slice(migrations, func(i, j int) bool {
+        return migrations[i].Version < migrations[j].Version
+    })
+    for i, m := range migrations {
+        if m.Version != i+1 {
+            return nil, fmt.Errorf("migration %d is missing", i+1)
+        }
+        if m.Up == "" || m.Down == "" {
+            return nil, fmt.Errorf("migration %d needs both an up and a down file", m.Version)
+        }
+    }
+    return migrations, nil
+}
+
+type Migrator struct {
+    db         *sql.DB
+    migrations []*Migration
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+    migrations, err := loadMigrations(migrationFiles)
+    if err != nil {
+        return nil, err
+    }
+    return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Advisory locks belong to a database session, so everything that happens
+// while holding the lock has to run on one and the same connection instead of
+// whatever the pool hands out.
+func (m *Migrator) withLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+    ctx := context.Background()
+    conn, err := m.db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    // This blocks until whoever else is migrating is done
+    if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+        return err
+    }
+    defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+    _, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(
+        version INTEGER PRIMARY KEY,
+        name VARCHAR(255) NOT NULL,
+        applied_at TIMESTAMP NOT NULL
+    )`)
+    if err != nil {
+        return err
+    }
+    return fn(ctx, conn)
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+    rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    applied := map[int]time.Time{}
+    for rows.Next() {
+        var (
+            version   int
+            appliedAt time.Time
+        )
+        if err := rows.Scan(&version, &appliedAt); err != nil {
+            return nil, err
+        }
+        applied[version] = appliedAt
+    }
+    return applied, rows.Err()
+}
+
+// Every migration runs in its own transaction together with the bookkeeping
+// in schema_migrations, so a failing migration leaves no trace behind.
+func runMigration(ctx context.Context, conn *sql.Conn, query, bookkeeping string, args ...any) error {
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx, query); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// Up applies every migration that has not been applied yet, in order, and
+// returns the ones it applied.
+func (m *Migrator) Up() ([]*Migration, error) {
+    done := []*Migration{}
+    err := m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+        applied, err := appliedVersions(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for _, mig := range m.migrations {
+            if _, ok := applied[mig.Version]; ok {
+                continue
+            }
+            err := runMigration(ctx, conn, mig.Up,
+                "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+                mig.Version, mig.Name, time.Now().UTC())
+            if err != nil {
+                return fmt.Errorf("migration %d (%s) failed: %w", mig.Version, mig.Name, err)
+            }
+            done = append(done, mig)
+        }
+        return nil
+    })
+    return done, err
+}
+
+// Down rolls back the last `steps` applied migrations, newest first, and
+// returns the ones it rolled back.
+func (m *Migrator) Down(steps int) ([]*Migration, error) {
+    done := []*Migration{}
+    err := m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+        applied, err := appliedVersions(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+            mig := m.migrations[i]
+            if _, ok := applied[mig.Version]; !ok {
+                continue
+            }
+            err := runMigration(ctx, conn, mig.Down,
+                "DELETE FROM schema_migrations WHERE version = $1",
+                mig.Version)
+            if err != nil {
+                return fmt.Errorf("rolling back migration %d (%s) failed: %w", mig.Version, mig.Name, err)
+            }
+            done = append(done, mig)
+        }
+        return nil
+    })
+    return done, err
+}
+
+// Pending counts the applied and the pending migrations. Unlike Status it 
+// does not take the lock, readiness probes must not queue up behind a 
+// migration that is running.
+func (m *Migrator) Pending(ctx context.Context) (applied, pending int, err error) {
+    rows, err := m.db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+    var pqErr *pq.Error
+    // Nothing has ever been migrated
+    if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+        return 0, len(m.migrations), nil
+    }
+    if err != nil {
+        return 0, 0, err
+    }
+    defer rows.Close()
+
+    versions := map[int]bool{}
+    for rows.Next() {
+        var version int
+        if err := rows.Scan(&version); err != nil {
+            return 0, 0, err
+        }
+        versions[version] = true
+    }
+    if err := rows.Err(); err != nil {
+        return 0, 0, err
+    }
+    for _, mig := range m.migrations {
+        if versions[mig.Version] {
+            applied++
+        } else {
+            pending++
+        }
+    }
+    return applied, pending, nil
+}
+
+// Status lists every known migration along with when it was applied (nil for
+// the ones that are still pending).
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+    statuses := []MigrationStatus{}
+    err := m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+        applied, err := appliedVersions(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for _, mig := range m.migrations {
+            status := MigrationStatus{Version: mig.Version, Name: mig.Name}
+            if at, ok := applied[mig.Version]; ok {
+                status.AppliedAt = &at
+            }
+            statuses = append(statuses, status)
+        }
+        return nil
+    })
+    return statuses, err
+}
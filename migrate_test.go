@@ -0,0 +1,41 @@
+package main
+
+import (
+    "testing"
+    "testing/fstest"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestLoadEmbeddedMigrations(t *testing.T){
+    migrations, err := loadMigrations(migrationFiles)
+    assert.Nil(t, err)
+    assert.NotEmpty(t, migrations)
+    for i, m := range migrations {
+        assert.Equal(t, i+1, m.Version)
+    }
+}
+
+func TestLoadMigrationsRejectsBrokenSets(t *testing.T){
+    sql := &fstest.MapFile{Data: []byte("SELECT 1;")}
+
+    // 0002 is missing
+    _, err := loadMigrations(fstest.MapFS{
+        "migrations/0001_a.up.sql": sql,
+        "migrations/0001_a.down.sql": sql,
+        "migrations/0003_c.up.sql": sql,
+        "migrations/0003_c.down.sql": sql,
+    })
+    assert.NotNil(t, err)
+
+    // no down file
+    _, err = loadMigrations(fstest.MapFS{
+        "migrations/0001_a.up.sql": sql,
+    })
+    assert.NotNil(t, err)
+
+    _, err = loadMigrations(fstest.MapFS{
+        "migrations/first.sql": sql,
+    })
+    assert.NotNil(t, err)
+}
@@ -0,0 +1,11 @@
+-- Baseline: the account table exactly as the server used to create it on
+-- startup, so that databases which already have it are left untouched.
+CREATE TABLE IF NOT EXISTS account(
+    id SERIAL PRIMARY KEY,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    number SERIAL,
+    encryptedPAssword VARCHAR(255),
+    balance SERIAL,
+    created_at TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS posting;
+DROP TABLE IF EXISTS journal_entry;
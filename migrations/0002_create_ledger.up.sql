@@ -0,0 +1,18 @@
+-- A journal entry groups the postings that make up one money movement.
+-- Postings do not reference the account table on purpose: deleting an
+-- account must never delete (or be blocked by) the history of the money that
+-- went through it, and system accounts have no row there anyway.
+CREATE TABLE IF NOT EXISTS journal_entry(
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    posted_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS posting(
+    id BIGSERIAL PRIMARY KEY,
+    entry_id BIGINT NOT NULL REFERENCES journal_entry(id),
+    account_id INTEGER NOT NULL,
+    amount BIGINT NOT NULL CHECK (amount <> 0),
+    balance_after BIGINT
+);
+CREATE INDEX IF NOT EXISTS posting_account_id_idx ON posting(account_id, id);
@@ -0,0 +1,8 @@
+-- status_code stays 0 while the first request is still being handled
+CREATE TABLE IF NOT EXISTS idempotency_key(
+    key VARCHAR(300) PRIMARY KEY,
+    fingerprint VARCHAR(64) NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    body BYTEA,
+    created_at TIMESTAMP NOT NULL
+);
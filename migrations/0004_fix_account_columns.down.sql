@@ -0,0 +1,8 @@
+-- The SERIAL defaults are not brought back, nothing ever depended on them.
+ALTER TABLE account RENAME COLUMN encrypted_password TO encryptedpassword;
+ALTER TABLE account
+    ALTER COLUMN number DROP NOT NULL,
+    ALTER COLUMN number TYPE INTEGER,
+    ALTER COLUMN balance DROP NOT NULL,
+    ALTER COLUMN balance DROP DEFAULT,
+    ALTER COLUMN balance TYPE INTEGER;
@@ -0,0 +1,16 @@
+-- number and balance were declared as SERIAL, which gave them a sequence
+-- backed default that nothing should ever rely on. Account numbers are drawn
+-- by the server and balances are maintained by the ledger, so both become
+-- plain BIGINT columns. The unquoted encryptedPAssword column was folded to
+-- lower case by PostgreSQL and gets a proper snake_case name.
+ALTER TABLE account
+    ALTER COLUMN number DROP DEFAULT,
+    ALTER COLUMN number TYPE BIGINT,
+    ALTER COLUMN number SET NOT NULL,
+    ALTER COLUMN balance DROP DEFAULT,
+    ALTER COLUMN balance TYPE BIGINT,
+    ALTER COLUMN balance SET DEFAULT 0,
+    ALTER COLUMN balance SET NOT NULL;
+DROP SEQUENCE IF EXISTS account_number_seq;
+DROP SEQUENCE IF EXISTS account_balance_seq;
+ALTER TABLE account RENAME COLUMN encryptedpassword TO encrypted_password;
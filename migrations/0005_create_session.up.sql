@@ -0,0 +1,18 @@
+-- A session is started by every login. Refresh tokens are only ever stored
+-- as SHA-256 hashes, used_at is set when a token is traded in for a new one.
+CREATE TABLE IF NOT EXISTS session(
+    id VARCHAR(64) PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS session_account_id_idx ON session(account_id);
+CREATE TABLE IF NOT EXISTS refresh_token(
+    token_hash VARCHAR(64) PRIMARY KEY,
+    session_id VARCHAR(64) NOT NULL REFERENCES session(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS refresh_token_session_id_idx ON refresh_token(session_id);
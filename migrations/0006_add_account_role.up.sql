@@ -0,0 +1,5 @@
+-- Every existing account becomes a customer, staff accounts have to be
+-- promoted by an admin through PUT /account/{id}/role.
+ALTER TABLE account
+    ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'customer'
+    CHECK (role IN ('customer', 'teller', 'admin'));
@@ -0,0 +1,22 @@
+-- TOTP secrets are only active once confirmed_at is set. Recovery codes and
+-- login challenge tokens are stored as SHA-256 hashes.
+CREATE TABLE IF NOT EXISTS account_totp(
+    account_id INTEGER PRIMARY KEY REFERENCES account(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP,
+    last_step BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS recovery_code(
+    account_id INTEGER NOT NULL REFERENCES account_totp(account_id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    PRIMARY KEY (account_id, code_hash)
+);
+CREATE TABLE IF NOT EXISTS login_challenge(
+    token_hash VARCHAR(64) PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,21 @@
+-- Failed login counters, keyed by "account:<number>" or "ip:<address>"
+CREATE TABLE IF NOT EXISTS login_throttle(
+    key VARCHAR(100) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP,
+    locked_until TIMESTAMP
+);
+-- Account numbers are kept as they are instead of referencing the account,
+-- locks are recorded for numbers that do not exist as well.
+CREATE TABLE IF NOT EXISTS lockout_event(
+    id BIGSERIAL PRIMARY KEY,
+    scope VARCHAR(20) NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    account_number BIGINT NOT NULL,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    failures INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP,
+    actor_number BIGINT,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS lockout_event_account_number_idx ON lockout_event(account_number);
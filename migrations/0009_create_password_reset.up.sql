@@ -0,0 +1,9 @@
+-- Reset tokens are only stored as SHA-256 hashes and work once (used_at)
+CREATE TABLE IF NOT EXISTS password_reset(
+    token_hash VARCHAR(64) PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS password_reset_account_id_idx ON password_reset(account_id);
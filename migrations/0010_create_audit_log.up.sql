@@ -0,0 +1,33 @@
+-- The audit log is append-only: the triggers below reject every UPDATE,
+-- DELETE and TRUNCATE, no matter who runs them. before and after are JSON
+-- rather than JSONB so that they come back exactly as they were written.
+-- Account numbers are not foreign keys, records outlive their accounts.
+CREATE TABLE IF NOT EXISTS audit_log(
+    id BIGSERIAL PRIMARY KEY,
+    action VARCHAR(50) NOT NULL,
+    actor_number BIGINT,
+    actor_role VARCHAR(20) NOT NULL DEFAULT '',
+    target_number BIGINT,
+    request_id VARCHAR(100) NOT NULL DEFAULT '',
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    before JSON,
+    after JSON,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_actor_number_idx ON audit_log(actor_number);
+CREATE INDEX IF NOT EXISTS audit_log_target_number_idx ON audit_log(target_number);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log(action);
+CREATE INDEX IF NOT EXISTS audit_log_request_id_idx ON audit_log(request_id);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update_delete
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
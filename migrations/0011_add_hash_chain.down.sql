@@ -0,0 +1,2 @@
+ALTER TABLE audit_log DROP COLUMN hash;
+ALTER TABLE journal_entry DROP COLUMN hash;
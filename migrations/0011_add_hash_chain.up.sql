@@ -0,0 +1,4 @@
+-- SHA-256 (hex) of the row plus the hash of the row before it, see chain.go.
+-- Rows from before this migration stay without a hash.
+ALTER TABLE journal_entry ADD COLUMN hash VARCHAR(64);
+ALTER TABLE audit_log ADD COLUMN hash VARCHAR(64);
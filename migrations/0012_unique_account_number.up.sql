@@ -0,0 +1,17 @@
+-- Account numbers used to be drawn without checking whether they were taken,
+-- so a database from back then can have two accounts with the same number.
+-- The index would fail on those with nothing but "could not create unique
+-- index", this names the numbers instead. See "Duplicate account numbers" in
+-- the README for how to fix them.
+DO $$
+DECLARE
+    duplicates TEXT;
+BEGIN
+    SELECT string_agg(number::TEXT, ', ' ORDER BY number) INTO duplicates
+    FROM (SELECT number FROM account GROUP BY number HAVING count(*) > 1) AS taken;
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'account numbers % belong to more than one account, give all but one of each a new number before migrating', duplicates;
+    END IF;
+END
+$$;
+CREATE UNIQUE INDEX IF NOT EXISTS account_number_key ON account(number);
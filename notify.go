@@ -0,0 +1,65 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+// -- NOTIFICATIONS
+// Some flows have to reach the customer outside of the API, e.g. the token
+// of a password reset must not simply be handed to whoever asked for it.
+// How that happens (email, SMS, ...) is up to the Notifier. Until a real one
+// exists there are two stand-ins for local development: one writes the
+// notifications to the log, the other appends them to a file as JSON lines.
+// Both of them write secrets in the clear, neither belongs in production.
+
+type Notification struct {
+    AccountNumber int64     `json:"account_number"`
+    Subject       string    `json:"subject"`
+    Body          string    `json:"body"`
+    CreatedAt     time.Time `json:"created_at"`
+}
+
+type Notifier interface {
+    Notify(*Notification) error
+}
+
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(n *Notification) error {
+    log.Printf("notification for %d: %s\n%s", n.AccountNumber, n.Subject, n.Body)
+    return nil
+}
+
+type FileNotifier struct {
+    mu   sync.Mutex
+    path string
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+    return &FileNotifier{path: path}
+}
+
+func (f *FileNotifier) Notify(n *Notification) error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    return json.NewEncoder(file).Encode(n)
+}
+
+// Picking the notifier from notify_file (NOTIFY_FILE): a path means the file
+// stand-in, nothing means the log.
+func NewNotifier(path string) Notifier {
+    if path != "" {
+        return NewFileNotifier(path)
+    }
+    return LogNotifier{}
+}
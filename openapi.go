@@ -0,0 +1,227 @@
+package main
+
+import (
+    _ "embed"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/getkin/kin-openapi/openapi3"
+    "github.com/getkin/kin-openapi/openapi3filter"
+    "github.com/getkin/kin-openapi/routers"
+    "github.com/getkin/kin-openapi/routers/gorillamux"
+    swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// -- OPENAPI
+// openapi.yaml describes every route of the API, what it expects and what it
+// answers with. It is embedded into the binary, served as JSON at
+// GET /openapi.json and can be browsed with Swagger UI at /docs/.
+//
+// It is also what requests are checked against before they reach a handler
+// (see withValidation). Parameters, headers and JSON bodies that do not match
+// it are turned away with validation_failed, listing every field that is
+// wrong:
+//
+//     {"code":"validation_failed","error":"request is invalid",
+//      "details":[{"field":"amount","in":"body","message":"value must be an integer"}]}
+//
+// The status is 422 when only the body is wrong, and stays the 400 that the
+// handlers have always answered a broken URL (or header) with otherwise.
+//
+// The document only gets to check the shape of a body: types, required
+// fields and fields that do not exist. Rules like the password policy or the
+// largest amount are described in it but checked by the handlers (see
+// validation.go), which report all of them together.
+//
+// Routes that the document does not know about go through unchecked, so a
+// new route has to be added to openapi.yaml to be validated (and documented).
+// Who gets to call what is still up to withJWT and authz.go, which run first.
+
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+type openAPISpec struct {
+    doc    *openapi3.T
+    router routers.Router
+    json   []byte
+}
+
+// The document is part of the binary, if it does not load the build is
+// broken and there is no point in starting.
+var apiSpec = mustLoadOpenAPI(openAPIDocument)
+
+func mustLoadOpenAPI(data []byte) *openAPISpec {
+    spec, err := loadOpenAPI(data)
+    if err != nil {
+        panic(fmt.Sprintf("openapi.yaml: %v", err))
+    }
+    return spec
+}
+
+func loadOpenAPI(data []byte) (*openAPISpec, error) {
+    loader := openapi3.NewLoader()
+    doc, err := loader.LoadFromData(data)
+    if err != nil {
+        return nil, err
+    }
+    if err := doc.Validate(loader.Context); err != nil {
+        return nil, err
+    }
+    router, err := gorillamux.NewRouter(doc)
+    if err != nil {
+        return nil, err
+    }
+    encoded, err := json.Marshal(doc)
+    if err != nil {
+        return nil, err
+    }
+    return &openAPISpec{doc: doc, router: router, json: encoded}, nil
+}
+
+var validationOptions = &openapi3filter.Options{
+    // Every problem with a request, not just the first one
+    MultiError: true,
+    // Tokens are checked by withJWT, which knows about sessions and roles
+    AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+    // The handlers get the request as it was sent
+    SkipSettingDefaults: true,
+}
+
+// Wrapped around every handler by makeHTTPHandleFunc, inside of withJWT and
+// authz.go. A caller without a valid token gets the 401 (and one without the
+// role the 403) without the body being read, let alone described field by
+// field.
+func withValidation(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        route, params, err := apiSpec.router.FindRoute(r)
+        if err != nil {
+            // Not in the document, or a method that the route does not take
+            // which the handler answers itself
+            next(w, r)
+            return
+        }
+        // The API only speaks JSON, clients that do not bother with a
+        // Content-Type get the benefit of the doubt.
+        r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+        checked := r.Clone(r.Context())
+        if checked.Header.Get("Content-Type") == "" {
+            checked.Header.Set("Content-Type", "application/json")
+        }
+        err = openapi3filter.ValidateRequest(r.Context(), &openapi3filter.RequestValidationInput{
+            Request: checked,
+            PathParams: params,
+            Route: route,
+            Options: validationOptions,
+        })
+        // Validating has read the body, the handler gets what was read
+        r.Body = checked.Body
+        if err != nil {
+            writeError(w, r, validationError(err))
+            return
+        }
+        next(w, r)
+    }
+}
+
+// Turning what the validator found into ErrValidationFailed. A body that is
+// missing or not JSON at all is the same invalid_json as before validation
+// existed, there are no fields to point at.
+func validationError(err error) error {
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        return ErrBodyTooLarge
+    }
+    var parseErr *openapi3filter.ParseError
+    if errors.As(err, &parseErr) && isBodyError(err) {
+        return ErrInvalidJSON
+    }
+    if errors.Is(err, openapi3filter.ErrInvalidRequired) && isBodyError(err) {
+        return ErrInvalidJSON
+    }
+    fields := fieldErrors(err, fieldInBody, fieldInBody)
+    apiErr := ErrValidationFailed.WithDetails(fields)
+    for _, f := range fields {
+        if f.In != fieldInBody {
+            apiErr.Status = http.StatusBadRequest
+        }
+    }
+    return apiErr
+}
+
+func isBodyError(err error) bool {
+    var reqErr *openapi3filter.RequestError
+    return errors.As(err, &reqErr) && reqErr.RequestBody != nil
+}
+
+func fieldErrors(err error, field, in string) []FieldError {
+    switch e := err.(type) {
+    case openapi3.MultiError:
+        fields := []FieldError{}
+        for _, err := range e {
+            fields = append(fields, fieldErrors(err, field, in)...)
+        }
+        return fields
+    case *openapi3filter.RequestError:
+        if e.Parameter != nil {
+            field, in = e.Parameter.Name, e.Parameter.In
+        }
+        if e.Err == nil {
+            return []FieldError{{Field: field, In: in, Message: e.Reason}}
+        }
+        return fieldErrors(e.Err, field, in)
+    case *openapi3.SchemaError:
+        // The pointer leads from the body (or the parameter) to the field,
+        // except for fields that should not be there which are reported on
+        // the object that has them.
+        path, message := e.JSONPointer(), e.Reason
+        var unknown string
+        if _, err := fmt.Sscanf(e.Reason, "property %q is unsupported", &unknown); err == nil {
+            path, message = append(path, unknown), "unknown field"
+        }
+        if len(path) > 0 {
+            if field == fieldInBody {
+                field = strings.Join(path, ".")
+            } else {
+                field += "." + strings.Join(path, ".")
+            }
+        }
+        return []FieldError{{Field: field, In: in, Message: message}}
+    }
+    return []FieldError{{Field: field, In: in, Message: err.Error()}}
+}
+
+// GET /openapi.json
+func (s *APIServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) error {
+    w.Header().Set("Content-Type", "application/json")
+    _, err := w.Write(apiSpec.json)
+    return err
+}
+
+// Swagger UI is served from the files bundled with swaggo/files, only the
+// script that tells it which document to load is ours.
+const swaggerInitializer = `window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "/openapi.json",
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+    plugins: [SwaggerUIBundle.plugins.DownloadUrl],
+    layout: "StandaloneLayout"
+  });
+};
+`
+
+func swaggerUIHandler() http.Handler {
+    files := http.StripPrefix("/docs/", http.FileServer(http.FS(swaggerFiles.FS)))
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/docs/swagger-initializer.js" {
+            w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+            w.Write([]byte(swaggerInitializer))
+            return
+        }
+        files.ServeHTTP(w, r)
+    })
+}
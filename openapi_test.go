@@ -0,0 +1,139 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/mux"
+    "github.com/stretchr/testify/assert"
+)
+
+// Every route has to be in openapi.yaml, otherwise it is neither documented
+// nor validated.
+func TestOpenAPICoversRoutes(t *testing.T){
+    server, _, _ := newTestServer()
+    err := server.routes().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+        path, err := route.GetPathTemplate()
+        if err != nil || strings.HasPrefix(path, "/docs") {
+            return nil
+        }
+        item := apiSpec.doc.Paths.Find(path)
+        if !assert.NotNil(t, item, "%s is not in openapi.yaml", path) {
+            return nil
+        }
+        methods, err := route.GetMethods()
+        if err != nil {
+            // Routes without .Methods() answer the rest with a 405 themselves
+            assert.NotEmpty(t, item.Operations(), path)
+            return nil
+        }
+        for _, method := range methods {
+            assert.NotNil(t, item.GetOperation(method), "%s %s is not in openapi.yaml", method, path)
+        }
+        return nil
+    })
+    assert.Nil(t, err)
+}
+
+func TestServeOpenAPI(t *testing.T){
+    server, _, router := newTestServer()
+    doc := map[string]any{}
+    rr := doRequest(t, router, "GET", "/openapi.json", "", nil, &doc)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Equal(t, "3.0.3", doc["openapi"])
+    assert.Contains(t, doc["paths"], "/transfer")
+
+    rr = doRequest(t, router, "GET", "/docs/", "", nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Contains(t, rr.Body.String(), "swagger-ui")
+    rr = doRequest(t, router, "GET", "/docs/swagger-initializer.js", "", nil, nil)
+    assert.Contains(t, rr.Body.String(), `url: "/openapi.json"`)
+
+    server.features.Docs = false
+    rr = doRequest(t, server.Router(), "GET", "/openapi.json", "", nil, nil)
+    assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestRequestValidation(t *testing.T){
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    teller := newTestAccount(t, store, 222222, 0)
+    store.UpdateAccountRole(ctx, teller.ID, RoleTeller)
+    teller.Role = RoleTeller
+    token := loginAs(t, server, from).Token
+    tellerToken := loginAs(t, server, teller).Token
+
+    send := func(token, method, path, body string) (*httptest.ResponseRecorder, *APIError, []FieldError) {
+        req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+        req.Header.Set("x-jwt-token", token)
+        rr := httptest.NewRecorder()
+        router.ServeHTTP(rr, req)
+        var resp struct {
+            APIError
+            Details []FieldError `json:"details"`
+        }
+        json.NewDecoder(rr.Body).Decode(&resp)
+        return rr, &resp.APIError, resp.Details
+    }
+
+    // Every wrong field of the body is listed
+    rr, apiErr, fields := send(token, "POST", "/transfer", `{"amount": "ten"}`)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    assert.Equal(t, "validation_failed", apiErr.Code)
+    assert.ElementsMatch(t, []string{"to_account", "amount"}, []string{fields[0].Field, fields[1].Field})
+    for _, f := range fields {
+        assert.Equal(t, "body", f.In)
+        assert.NotEmpty(t, f.Message)
+    }
+
+    // The handler still gets to read the body after it has been validated
+    transfer := new(Transfer)
+    req := httptest.NewRequest("POST", "/transfer", bytes.NewBufferString(`{"to_account": 222222, "amount": 40}`))
+    req.Header.Set("x-jwt-token", token)
+    req.Header.Set("Content-Type", "application/json")
+    rr = httptest.NewRecorder()
+    router.ServeHTTP(rr, req)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Nil(t, json.NewDecoder(rr.Body).Decode(transfer))
+    assert.Equal(t, int64(40), transfer.Amount)
+
+    // Broken parameters are a 400, like the handlers answered them before
+    rr, apiErr, fields = send(token, "GET", "/account/1/transactions?limit=0&direction=sideways", "")
+    assert.Equal(t, http.StatusBadRequest, rr.Code)
+    assert.Equal(t, "validation_failed", apiErr.Code)
+    if assert.Len(t, fields, 2) {
+        assert.Equal(t, FieldError{Field: "limit", In: "query", Message: fields[0].Message}, fields[0])
+        assert.Equal(t, "direction", fields[1].Field)
+    }
+    rr, _, fields = send(tellerToken, "GET", "/account/abc", "")
+    assert.Equal(t, http.StatusBadRequest, rr.Code)
+    if assert.Len(t, fields, 1) {
+        assert.Equal(t, "path", fields[0].In)
+    }
+
+    // Bodies which are not JSON have no fields to point at
+    rr, apiErr, _ = send(token, "POST", "/transfer", `{"to_account": `)
+    assert.Equal(t, http.StatusBadRequest, rr.Code)
+    assert.Equal(t, "invalid_json", apiErr.Code)
+    rr, apiErr, _ = send(token, "POST", "/transfer", "")
+    assert.Equal(t, "invalid_json", apiErr.Code)
+
+    // Methods that the document does not list are left to the handler
+    rr, apiErr, _ = send(token, "GET", "/transfer", "")
+    assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+    // Callers that may not use the route at all are not told what is wrong
+    // with their request
+    rr, apiErr, fields = send("", "POST", "/transfer", `{"amount": "ten", "from_account": 222222}`)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    assert.Equal(t, "unauthenticated", apiErr.Code)
+    assert.Empty(t, fields)
+    rr, _, _ = send(token, "GET", "/audit?from=yesterday", "")
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+    rr, _, _ = send(token, "PUT", "/account/1/role", `{"role": 7}`)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+)
+
+// -- PASSWORDS
+// Customers can change their password while logged in (which needs the
+// current one), or reset it when they have forgotten it. A reset starts with
+// a single use token that is sent through the Notifier, never in the
+// response, and is only stored as a hash. Either way every session of the
+// account gets revoked, so whoever might have been logged in with the old
+// password is thrown out.
+
+const (
+    minPasswordLength     = 8
+    // Argon2 does not mind long passwords, but hashing a few kilobytes on
+    // every login is a cheap way to keep the server busy
+    maxPasswordLength     = 128
+    passwordResetTokenTTL = 30 * time.Minute
+)
+
+var (
+    ErrWrongPassword     = NewAPIError(http.StatusUnprocessableEntity, "wrong_password", "current password is wrong")
+    ErrInvalidResetToken = NewAPIError(http.StatusUnprocessableEntity, "invalid_reset_token",
+        "password reset token is invalid, has expired or has already been used")
+)
+
+type PasswordReset struct {
+    TokenHash string
+    AccountID int
+    CreatedAt time.Time
+    ExpiresAt time.Time
+    UsedAt    *time.Time
+}
+
+// The rules for accepting a reset token, PostgresStore has them in the WHERE
+// of its UPDATE.
+func checkPasswordReset(p *PasswordReset, now time.Time) error {
+    if p.UsedAt != nil || !now.Before(p.ExpiresAt) {
+        return ErrInvalidResetToken
+    }
+    return nil
+}
+
+// -- OUTDATED
+// A weak password used to be a weak_password error of its own. It is one of
+// the fields of validation_failed now (see validation.go), so that signing up
+// with a bad name and a bad password reports both.
+
+// The most common passwords that would get past the other rules. Not meant
+// to be complete, just to stop the very first guesses from working.
+var commonPasswords = map[string]bool{
+    "password1": true, "password123": true, "passw0rd": true, "qwerty123": true,
+    "abc12345": true, "abcd1234": true, "letmein1": true, "welcome1": true,
+    "iloveyou1": true, "1q2w3e4r": true, "1qaz2wsx": true, "zaq12wsx": true,
+}
+
+// The policy for new passwords, existing ones keep working as they are
+func checkNewPassword(pw string) error {
+    var letter, other bool
+    for _, r := range pw {
+        if unicode.IsLetter(r) {
+            letter = true
+        } else {
+            other = true
+        }
+    }
+    switch n := utf8.RuneCountInString(pw); {
+    case n < minPasswordLength:
+        return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+    case n > maxPasswordLength:
+        return fmt.Errorf("password must be at most %d characters long", maxPasswordLength)
+    case !letter || !other:
+        return errors.New("password must contain a letter and a digit or symbol")
+    case commonPasswords[strings.ToLower(pw)]:
+        return errors.New("password is too common")
+    }
+    return nil
+}
+
+// PUT /account/{id}/password
+// Answers with a fresh session, the one that made the request has been
+// revoked along with all the others.
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    account, ok := authAccount(r)
+    if !ok {
+        return ErrNotAuthenticated
+    }
+    req := new(ChangePasswordRequest)
+    if err := decodeRequest(w, r, req); err != nil {
+        return err
+    }
+    // Somebody with a stolen access token could otherwise guess the current
+    // password here without ever running into the login lockout.
+    if err := s.checkLoginLockout(w, r, account.Number); err != nil {
+        return err
+    }
+    if !account.ValidPassword(req.CurrentPassword) {
+        if err := s.recordLoginFailure(r, account.Number); err != nil {
+            return err
+        }
+        return ErrWrongPassword
+    }
+    encpw, err := hashPassword(req.NewPassword)
+    if err != nil {
+        return err
+    }
+    if err := s.store.UpdatePassword(ctx, account.ID, encpw, time.Now().UTC()); err != nil {
+        return err
+    }
+    // Never the hashes, not even in the audit log
+    s.audit(r, auditEvent{Action: AuditPasswordChanged, Target: account.Number})
+    resp, err := s.startSession(ctx, account)
+    if err != nil {
+        return err
+    }
+    return WriteJSON(w, http.StatusOK, resp)
+}
+
+// POST /password/reset/request
+// Always answers the same, whether the account exists or not, so that it
+// cannot be used to find out which account numbers are in use.
+func (s *APIServer) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    req := new(PasswordResetRequest)
+    if err := decodeRequest(w, r, req); err != nil {
+        return err
+    }
+    accepted := map[string]string{"status": "if the account exists, a reset token is on its way"}
+    s.audit(r, auditEvent{Action: AuditPasswordResetRequested, Target: req.Number})
+
+    acc, err := s.store.GetAccountByNumber(ctx, int(req.Number))
+    if errors.Is(err, ErrAccountNotFound) {
+        return WriteJSON(w, http.StatusAccepted, accepted)
+    }
+    if err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    plain, err := randomToken(32)
+    if err != nil {
+        return err
+    }
+    reset := &PasswordReset{
+        TokenHash: hashToken(plain),
+        AccountID: acc.ID,
+        CreatedAt: now,
+        ExpiresAt: now.Add(passwordResetTokenTTL),
+    }
+    if err := s.store.CreatePasswordReset(ctx, reset); err != nil {
+        return err
+    }
+    err = s.notifier.Notify(&Notification{
+        AccountNumber: acc.Number,
+        Subject: "Password reset",
+        Body: fmt.Sprintf("Use this token to reset your password within %s: %s", passwordResetTokenTTL, plain),
+        CreatedAt: now,
+    })
+    if err != nil {
+        return err
+    }
+    return WriteJSON(w, http.StatusAccepted, accepted)
+}
+
+// POST /password/reset
+// Setting a new password with a reset token. The failed logins of the
+// account are forgotten as well, a customer locked out by their own guesses
+// is exactly who ends up here.
+func (s *APIServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    req := new(ResetPasswordRequest)
+    if err := decodeRequest(w, r, req); err != nil {
+        return err
+    }
+    encpw, err := hashPassword(req.NewPassword)
+    if err != nil {
+        return err
+    }
+    accountID, err := s.store.ResetPassword(ctx, hashToken(req.Token), encpw, time.Now().UTC())
+    if err != nil {
+        return err
+    }
+    acc, err := s.store.GetAccountByID(ctx, accountID)
+    if err != nil {
+        return err
+    }
+    if err := s.clearLoginFailures(ctx, acc.Number); err != nil {
+        return err
+    }
+    s.audit(r, auditEvent{Action: AuditPasswordReset, Actor: acc, Target: acc.Number})
+    return WriteJSON(w, http.StatusOK, map[string]bool{"password_reset": true})
+}
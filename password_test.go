@@ -0,0 +1,93 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+// Keeping notifications around instead of sending them anywhere
+type recordingNotifier struct {
+    sent []*Notification
+}
+
+func (n *recordingNotifier) Notify(msg *Notification) error {
+    n.sent = append(n.sent, msg)
+    return nil
+}
+
+func TestChangePassword(t *testing.T){
+    server, store, router := newTestServer()
+    acc, err := NewAccount("a", "b", "hello123")
+    assert.Nil(t, err)
+    assert.Nil(t, store.CreateAccount(ctx, acc))
+    other := newTestAccount(t, store, 222222, 0)
+    old := loginAs(t, server, acc)
+
+    apiErr := new(APIError)
+    rr := doRequest(t, router, "PUT", "/account/1/password", old.Token, ChangePasswordRequest{"wrong", "brand-new-pw"}, apiErr)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    assert.Equal(t, "wrong_password", apiErr.Code)
+    rr = doRequest(t, router, "PUT", "/account/1/password", old.Token, ChangePasswordRequest{"hello123", "short"}, apiErr)
+    assert.Equal(t, "validation_failed", apiErr.Code)
+    assert.Equal(t, "new_password", apiErr.Details.([]any)[0].(map[string]any)["field"])
+    // Only ever your own password
+    otherToken := loginAs(t, server, other).Token
+    rr = doRequest(t, router, "PUT", "/account/1/password", otherToken, ChangePasswordRequest{"hello123", "brand-new-pw"}, nil)
+    assert.Equal(t, http.StatusForbidden, rr.Code)
+
+    fresh := new(LoginResponse)
+    rr = doRequest(t, router, "PUT", "/account/1/password", old.Token, ChangePasswordRequest{"hello123", "brand-new-pw"}, fresh)
+    assert.Equal(t, http.StatusOK, rr.Code)
+
+    // The old session is gone, the new one works and so does the password
+    rr = doRequest(t, router, "GET", "/account/1", old.Token, nil, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    rr = doRequest(t, router, "POST", "/token/refresh", "", RefreshRequest{old.RefreshToken}, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    rr = doRequest(t, router, "GET", "/account/1", fresh.Token, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    rr = doRequest(t, router, "POST", "/login", "", LoginRequest{acc.Number, "hello123"}, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    rr = doRequest(t, router, "POST", "/login", "", LoginRequest{acc.Number, "brand-new-pw"}, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestResetPassword(t *testing.T){
+    server, store, router := newTestServer()
+    notifier := &recordingNotifier{}
+    server.notifier = notifier
+    acc, err := NewAccount("a", "b", "hello123")
+    assert.Nil(t, err)
+    assert.Nil(t, store.CreateAccount(ctx, acc))
+    session := loginAs(t, server, acc)
+
+    // Unknown accounts get the same answer, but nothing is sent
+    rr := doRequest(t, router, "POST", "/password/reset/request", "", PasswordResetRequest{999999}, nil)
+    assert.Equal(t, http.StatusAccepted, rr.Code)
+    assert.Empty(t, notifier.sent)
+
+    rr = doRequest(t, router, "POST", "/password/reset/request", "", PasswordResetRequest{acc.Number}, nil)
+    assert.Equal(t, http.StatusAccepted, rr.Code)
+    assert.NotContains(t, rr.Body.String(), "token:")
+    assert.Len(t, notifier.sent, 1)
+    assert.Equal(t, acc.Number, notifier.sent[0].AccountNumber)
+    body := notifier.sent[0].Body
+    token := body[strings.LastIndex(body, " ")+1:]
+
+    apiErr := new(APIError)
+    rr = doRequest(t, router, "POST", "/password/reset", "", ResetPasswordRequest{"made-up", "brand-new-pw"}, apiErr)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    assert.Equal(t, "invalid_reset_token", apiErr.Code)
+    rr = doRequest(t, router, "POST", "/password/reset", "", ResetPasswordRequest{token, "brand-new-pw"}, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    rr = doRequest(t, router, "POST", "/password/reset", "", ResetPasswordRequest{token, "another-new-pw"}, apiErr)
+    assert.Equal(t, "invalid_reset_token", apiErr.Code)
+
+    rr = doRequest(t, router, "GET", "/account/1", session.Token, nil, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    rr = doRequest(t, router, "POST", "/login", "", LoginRequest{acc.Number, "brand-new-pw"}, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+}
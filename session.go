@@ -0,0 +1,206 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "net/http"
+    "time"
+
+    jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// -- SESSIONS AND REFRESH TOKENS
+// Logging in starts a session. The client gets a short lived access token
+// (JWT) and a long lived, opaque refresh token. Access tokens are not stored
+// anywhere, they carry the session ID (sid) so that withJWT can reject them
+// once the session has been revoked. Refresh tokens are only stored as
+// SHA-256 hashes and can be used exactly once: every refresh hands out a new
+// one (rotation). If an already used refresh token shows up again, somebody
+// has a copy of it, so the whole session gets revoked (reuse detection).
+
+type TokenConfig struct {
+    AccessTTL  time.Duration
+    RefreshTTL time.Duration
+}
+
+func DefaultTokenConfig() TokenConfig {
+    return TokenConfig{
+        AccessTTL: 15 * time.Minute,
+        RefreshTTL: 7 * 24 * time.Hour,
+    }
+}
+
+// The lifetimes can be changed with auth.access_ttl and auth.refresh_ttl (or
+// JWT_ACCESS_TTL and JWT_REFRESH_TTL), see config.go
+
+var (
+    ErrSessionNotFound     = NewAPIError(http.StatusUnauthorized, "session_not_found", "session not found")
+    ErrInvalidRefreshToken = NewAPIError(http.StatusUnauthorized, "invalid_refresh_token", "refresh token is invalid or has expired")
+    ErrRefreshTokenReused  = NewAPIError(http.StatusUnauthorized, "refresh_token_reused",
+        "refresh token has already been used, the session has been revoked")
+)
+
+type Session struct {
+    ID        string
+    AccountID int
+    CreatedAt time.Time
+    ExpiresAt time.Time
+    RevokedAt *time.Time
+}
+
+func (s *Session) Active(now time.Time) bool {
+    return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+type RefreshToken struct {
+    TokenHash string
+    SessionID string
+    CreatedAt time.Time
+    ExpiresAt time.Time
+    UsedAt    *time.Time
+}
+
+// The rules for accepting a refresh token, shared by every store. Reuse is
+// checked first on purpose: an old token showing up must revoke the session
+// even if it has expired in the meantime.
+func checkRefreshToken(tok *RefreshToken, sess *Session, now time.Time) error {
+    if tok.UsedAt != nil {
+        return ErrRefreshTokenReused
+    }
+    if !now.Before(tok.ExpiresAt) || !sess.Active(now) {
+        return ErrInvalidRefreshToken
+    }
+    return nil
+}
+
+// The claims inside of an access token. AccountNumber keeps its old name so
+// that clients reading it do not break.
+type Claims struct {
+    AccountNumber int64  `json:"AccountNumber"`
+    Role          string `json:"role"`
+    SessionID     string `json:"sid"`
+    jwt.RegisteredClaims
+}
+
+// Random, URL safe strings for session IDs, token IDs and refresh tokens
+func randomToken(size int) (string, error) {
+    b := make([]byte, size)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// Creating a refresh token for a session. The plain token goes back to the
+// client, only its hash ends up in the store.
+func newRefreshToken(sessionID string, now time.Time, ttl time.Duration) (string, *RefreshToken, error) {
+    plain, err := randomToken(32)
+    if err != nil {
+        return "", nil, err
+    }
+    return plain, &RefreshToken{
+        TokenHash: hashToken(plain),
+        SessionID: sessionID,
+        CreatedAt: now,
+        ExpiresAt: now.Add(ttl),
+    }, nil
+}
+
+// Starting a new session for an account that has just proven who it is. The
+// session lives for RefreshTTL from now, refreshing does not extend it, so a
+// stolen refresh token cannot be used to stay logged in forever.
+func (s *APIServer) startSession(ctx context.Context, acc *Account) (*LoginResponse, error) {
+    now := time.Now().UTC()
+    id, err := randomToken(16)
+    if err != nil {
+        return nil, err
+    }
+    session := &Session{
+        ID: id,
+        AccountID: acc.ID,
+        CreatedAt: now,
+        ExpiresAt: now.Add(s.tokens.RefreshTTL),
+    }
+    plain, refresh, err := newRefreshToken(session.ID, now, s.tokens.RefreshTTL)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.store.CreateSession(ctx, session, refresh); err != nil {
+        return nil, err
+    }
+    return s.tokenResponse(acc, session.ID, plain, now)
+}
+
+func (s *APIServer) tokenResponse(acc *Account, sessionID, refresh string, now time.Time) (*LoginResponse, error) {
+    expiresAt := now.Add(s.tokens.AccessTTL)
+    token, err := createJWT(s.keys, acc, sessionID, now, expiresAt)
+    if err != nil {
+        return nil, err
+    }
+    return &LoginResponse{
+        Number: acc.Number,
+        Token: token,
+        ExpiresAt: expiresAt,
+        RefreshToken: refresh,
+    }, nil
+}
+
+// POST /token/refresh
+// Trading a refresh token for a new access token and a new refresh token
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    if r.Method != "POST" {
+        return errMethodNotAllowed(r.Method)
+    }
+    req := new(RefreshRequest)
+    if err := decodeRequest(w, r, req); err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    plain, next, err := newRefreshToken("", now, s.tokens.RefreshTTL)
+    if err != nil {
+        return err
+    }
+    session, err := s.store.RotateRefreshToken(ctx, hashToken(req.RefreshToken), next, now)
+    if err != nil {
+        return err
+    }
+    acc, err := s.store.GetAccountByID(ctx, session.AccountID)
+    if err != nil {
+        return err
+    }
+    resp, err := s.tokenResponse(acc, session.ID, plain, now)
+    if err != nil {
+        return err
+    }
+    return WriteJSON(w, http.StatusOK, resp)
+}
+
+// POST /logout
+// Revoking the session of the access token that was used to call this. Both
+// the access token and every refresh token of the session stop working.
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    if r.Method != "POST" {
+        return errMethodNotAllowed(r.Method)
+    }
+    claims, ok := authClaims(r)
+    if !ok {
+        return ErrNotAuthenticated
+    }
+    if err := s.store.RevokeSession(ctx, claims.SessionID, time.Now().UTC()); err != nil {
+        return err
+    }
+    account, _ := authAccount(r)
+    s.audit(r, auditEvent{Action: AuditLogout, Target: account.Number})
+    return WriteJSON(w, http.StatusOK, map[string]string{"logged_out": claims.SessionID})
+}
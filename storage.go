@@ -1,135 +1,320 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"os" 
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
 
-    "github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+    "go.opentelemetry.io/otel/trace"
 )
 
-// The "lib/pq" package is imported but escaped because we do not need anything
-// from the package itself, we just need it to initialize the PostgreSQL
-// driver which will interact with the "database/sql" package.
+// The "lib/pq" package initializes the PostgreSQL driver which will interact
+// with the "database/sql" package. Apart from that we only need pq.Array from
+// it for passing slices as query parameters.
 
+// Every method takes the context of the request it is working for, so that
+// the work stops once the client is gone (see PostgresStore.operation).
 type Storage interface {
-    CreateAccount(*Account) error
-    DeleteAccount(int) error
-    GetAccounts()([]*Account, error)
-    GetAccountByID(int) (*Account, error)
-    GetAccountByNumber(int) (*Account, error)
+    CreateAccount(ctx context.Context, acc *Account) error
+    DeleteAccount(ctx context.Context, id int) error
+    GetAccounts(ctx context.Context) ([]*Account, error)
+    GetAccountByID(ctx context.Context, id int) (*Account, error)
+    GetAccountByNumber(ctx context.Context, number int) (*Account, error)
+    UpdateAccountRole(ctx context.Context, id int, role string) (*Account, error)
+    Transfer(ctx context.Context, fromID int, toNumber int64, amount int64) (*Transfer, error)
+    Deposit(ctx context.Context, accountID int, amount int64) (*JournalEntry, error)
+    Withdraw(ctx context.Context, accountID int, amount int64) (*JournalEntry, error)
+    CheckLedger(ctx context.Context) (*LedgerReport, error)
+    VerifyLedgerChain(ctx context.Context) (*ChainReport, error)
+    GetTransactions(ctx context.Context, accountID int, q *TransactionQuery) (*TransactionPage, error)
+    ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error)
+    CompleteIdempotencyKey(ctx context.Context, key string, status int, body []byte) error
+    ReleaseIdempotencyKey(ctx context.Context, key string) error
+    CreateSession(ctx context.Context, session *Session, refresh *RefreshToken) error
+    GetSession(ctx context.Context, id string) (*Session, error)
+    RotateRefreshToken(ctx context.Context, oldHash string, next *RefreshToken, now time.Time) (*Session, error)
+    RevokeSession(ctx context.Context, id string, now time.Time) error
+    SaveTOTP(ctx context.Context, t *TOTP) error
+    GetTOTP(ctx context.Context, accountID int) (*TOTP, error)
+    ConfirmTOTP(ctx context.Context, accountID int, step int64, recoveryHashes []string, now time.Time) error
+    UseTOTPStep(ctx context.Context, accountID int, step int64) error
+    UseRecoveryCode(ctx context.Context, accountID int, codeHash string, now time.Time) error
+    DeleteTOTP(ctx context.Context, accountID int) error
+    CreateLoginChallenge(ctx context.Context, c *LoginChallenge) error
+    UseLoginChallenge(ctx context.Context, tokenHash string, now time.Time) (*LoginChallenge, error)
+    DeleteLoginChallenge(ctx context.Context, tokenHash string) error
+    GetLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error)
+    RecordLoginFailure(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (*LoginThrottle, bool, error)
+    ResetLoginThrottle(ctx context.Context, key string) error
+    CreateLockoutEvent(ctx context.Context, e *LockoutEvent) error
+    GetLockoutEvents(ctx context.Context, accountNumber int64) ([]*LockoutEvent, error)
+    UpdatePassword(ctx context.Context, accountID int, encryptedPassword string, now time.Time) error
+    UpdatePasswordHash(ctx context.Context, accountID int, oldHash, newHash string) error
+    CreatePasswordReset(ctx context.Context, p *PasswordReset) error
+    ResetPassword(ctx context.Context, tokenHash string, encryptedPassword string, now time.Time) (int, error)
+    AppendAudit(ctx context.Context, rec *AuditRecord) error
+    GetAuditRecords(ctx context.Context, q *AuditQuery) (*AuditPage, error)
+    VerifyAuditChain(ctx context.Context) (*ChainReport, error)
+    // Whether the store can be reached at all, for the readiness probe
+    Ping(ctx context.Context) error
+    // Releasing the connections once the server is done with the store
+    Close() error
+}
+
+// Errors that can come out of a transfer. They are kept as sentinel values so
+// that callers can check for them with errors.Is() instead of comparing
+// strings.
+var (
+    ErrInvalidAmount      = NewAPIError(http.StatusUnprocessableEntity, "invalid_amount", "transfer amount must be greater than zero")
+    ErrSelfTransfer       = NewAPIError(http.StatusUnprocessableEntity, "self_transfer", "cannot transfer money to the same account")
+    ErrUnknownDestination = NewAPIError(http.StatusUnprocessableEntity, "unknown_destination", "destination account not found")
+    ErrInsufficientFunds  = NewAPIError(http.StatusUnprocessableEntity, "insufficient_funds", "insufficient funds")
+)
+
+// Every store has to report missing and duplicate accounts in exactly the
+// same way, so that the API behaves the same no matter what it is running on.
+// The not found errors carry the ID (or number) in their message, use 
+// errors.Is(err, ErrAccountNotFound) to check for them.
+var (
+    ErrAccountNotFound    = NewAPIError(http.StatusNotFound, "account_not_found", "account not found")
+    ErrAccountNumberTaken = NewAPIError(http.StatusConflict, "account_number_taken", "account number is already taken")
+    // The postings of an account stay behind when it is deleted, its money
+    // would be gone from every balance but still be in the ledger.
+    ErrAccountNotEmpty    = NewAPIError(http.StatusConflict, "account_not_empty", "account still has a balance, it has to be paid out first")
+)
+
+func errAccountNotFound(id int) error {
+    return NewAPIError(ErrAccountNotFound.Status, ErrAccountNotFound.Code, "account %d not found", id)
+}
+
+func errAccountNumberNotFound(number int) error {
+    return NewAPIError(ErrAccountNotFound.Status, ErrAccountNotFound.Code, "Account with number [%d] not found", number)
 }
 
 type PostgresStore struct {
-    db *sql.DB
+    db           *sql.DB
+    queryTimeout time.Duration
 }
 
-func NewPostgresStore() (*PostgresStore, error) {
-    // Incase environment variables do not load properly, then handle the error
-    err := godotenv.Load()
-    if err != nil {
-        fmt.Println("Error loading .env file", err)
-        return nil, err
-    }
-    connStr := os.Getenv("DATABASE_URL")
-    db, err := sql.Open("postgres", connStr)
+// -- OUTDATED
+// The connection string used to come straight from a .env file which had to
+// exist. It is now part of the config (see config.go), along with the pool
+// settings.
+func NewPostgresStore(cfg DatabaseConfig) (*PostgresStore, error) {
+    db, err := sql.Open("postgres", cfg.URL)
     // Check for error during connection
     if err != nil {
         return nil, err
     }
+    db.SetMaxOpenConns(cfg.MaxOpenConns)
+    db.SetMaxIdleConns(cfg.MaxIdleConns)
+    db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+    db.SetConnMaxIdleTime(time.Duration(cfg.ConnMaxIdleTime))
+    s := &PostgresStore{
+        db: db,
+        queryTimeout: time.Duration(cfg.QueryTimeout),
+    }
     // Checking for error post connection
-    if err := db.Ping(); err != nil {
+    ctx, done := s.operation(context.Background())
+    defer done()
+    if err := db.PingContext(ctx); err != nil {
         return nil, err
     }
-    // Return
-    return &PostgresStore{
-        db: db,
-    }, nil
+    return s, nil
+}
+
+// Every operation runs with the context of the request that asked for it, so
+// a client that hangs up stops its queries as well. On top of that each one 
+// gets a deadline of its own, a slow query or a lock that is never released 
+// fails the request instead of tying up a connection for good. Walking the 
+// whole ledger (CheckLedger, the Verify* methods) is left to the caller.
+//
+// Every operation is a span of its own as well (see tracing.go), named after
+// the method. Running out of time is logged with the logger of the request, 
+// which is the only place that can tell which operation it was.
+func (s *PostgresStore) operation(ctx context.Context) (context.Context, func()) {
+    name := callerName(2)
+    ctx, span := startStoreSpan(ctx, name)
+    opCtx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+    return opCtx, func() {
+        if errors.Is(opCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+            loggerFrom(ctx).Warn("database operation timed out", 
+                "operation", name, 
+                "timeout", s.queryTimeout.String())
+            span.SetStatus(codes.Error, "timed out")
+        }
+        span.End()
+        cancel()
+    }
+}
+
+func startStoreSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+    return tracer().Start(ctx, "PostgresStore."+name, 
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperationName(name)))
+}
+
+// The name of the method that called operation(), without the package
+func callerName(skip int) string {
+    pc, _, _, ok := runtime.Caller(skip)
+    if !ok {
+        return "unknown"
+    }
+    name := runtime.FuncForPC(pc).Name()
+    return name[strings.LastIndex(name, ".")+1:]
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+    return s.db.PingContext(ctx)
+}
+
+func (s *PostgresStore) Close() error {
+    return s.db.Close()
 }
 
 func (s *PostgresStore) Init() error {
-    // for initializing a database, there should be a default accounts table 
-    // ready to accept incoming data.
-    return s.CreateAccountTable()
-}
-
-func (s *PostgresStore) CreateAccountTable() error {
-    query := `CREATE TABLE IF NOT EXISTS account(
-        id SERIAL PRIMARY KEY,
-        first_name VARCHAR(50),
-        last_name VARCHAR(50),
-        number SERIAL,
-        encryptedPAssword VARCHAR(255),
-        balance SERIAL,
-        created_at TIMESTAMP
-    )`
-    _, err := s.db.Exec(query)
+    // for initializing a database, the schema has to be brought up to date 
+    // before the server can accept any incoming data. See migrate.go
+    migrator, err := NewMigrator(s.db)
+    if err != nil {
+        return err
+    }
+    applied, err := migrator.Up()
+    for _, m := range applied {
+        log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+    }
     return err
 }
 
-
 // CRUD operations
-func (s *PostgresStore) CreateAccount(acc *Account) error {
+func (s *PostgresStore) CreateAccount(ctx context.Context, acc *Account) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
     query := `
     INSERT INTO account 
-    (first_name, last_name, number, balance, created_at, encryptedPassword)
+    (first_name, last_name, number, balance, created_at, encrypted_password, role)
     VALUES 
-    ($1, $2, $3, $4, $5, $6)`
-    _, err := s.db.Query(
+    ($1, $2, $3, $4, $5, $6, $7)
+    RETURNING id`
+    err := s.db.QueryRowContext(ctx, 
         query, 
         acc.FirstName, 
         acc.LastName, 
         acc.Number, 
         acc.Balance, 
         acc.CreatedAt,
-        acc.EncryptedPassword)
+        acc.EncryptedPassword,
+        acc.Role).Scan(&acc.ID)
+    // 23505 is the PostgreSQL error code for a unique_violation, the only 
+    // unique column that we insert into is the account number.
+    var pqErr *pq.Error
+    if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+        return ErrAccountNumberTaken
+    }
     if err != nil {
         return err
     }
     return nil
 }
 
-func (s *PostgresStore) DeleteAccount(id int) error {
-    // After deleting a field, you need not return the deleted field but just 
-    // the confirmation of whether they have been deleted or not.
-    _, err := s.db.Query("DELETE FROM account WHERE id = $1", id)
-    return err
-}
+func (s *PostgresStore) DeleteAccount(ctx context.Context, id int) error {
+    ctx, done := s.operation(ctx)
+    defer done()
 
-func (s *PostgresStore) GetAccountByID(id int) (*Account, error) {
-    rows, err := s.db.Query("SELECT * FROM account WHERE id = $1", id)
+    tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
-        return nil, err
+        return err
     }
-    for rows.Next(){
-        // scanIntoAccount directly returns an account pointer and error
-        return scanIntoAccount(rows)
+    defer tx.Rollback()
+
+    // Locked, so that no transfer can credit the account between checking
+    // the balance and deleting it
+    var balance int64
+    err = tx.QueryRowContext(ctx, "SELECT balance FROM account WHERE id = $1 FOR UPDATE", id).Scan(&balance)
+    if errors.Is(err, sql.ErrNoRows) {
+        return errAccountNotFound(id)
+    }
+    if err != nil {
+        return err
+    }
+    if balance != 0 {
+        return ErrAccountNotEmpty
+    }
+    if _, err := tx.ExecContext(ctx, "DELETE FROM account WHERE id = $1", id); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// -- OUTDATED
+// Both lookups used to go through db.Query() and return from inside the 
+// rows.Next() loop without ever closing the rows, which kept a connection 
+// checked out of the pool every time. There is at most one row, so 
+// QueryRowContext does the job and releases the connection on Scan().
+func (s *PostgresStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    account, err := scanIntoAccount(s.db.QueryRowContext(ctx, "SELECT * FROM account WHERE id = $1", id))
+    // No row matched the particular ID, in which case we do not need to 
+    // return any pointer but we must return an error
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, errAccountNotFound(id)
+    }
+    return account, err
+}
+
+func (s *PostgresStore) GetAccountByNumber(ctx context.Context, number int) (*Account, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    account, err := scanIntoAccount(s.db.QueryRowContext(ctx, "SELECT * FROM account WHERE number = $1", number))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, errAccountNumberNotFound(number)
     }
-    // if there was no rows.Next() then the table did not contain 
-    // a single row which matched the particular ID, in which case,
-    // we do not need to return any pointer but we must return an error
-    return nil, fmt.Errorf("account %d not found", id)
+    return account, err
 }
 
-func (s *PostgresStore) GetAccountByNumber(number int) (*Account, error) {
-    rows, err := s.db.Query("SELECT * FROM account WHERE number = $1", number)
+func (s *PostgresStore) UpdateAccountRole(ctx context.Context, id int, role string) (*Account, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    rows, err := s.db.QueryContext(ctx, "UPDATE account SET role = $1 WHERE id = $2 RETURNING *", role, id)
     if err != nil {
         return nil, err
     }
+    defer rows.Close()
 
     for rows.Next(){
         return scanIntoAccount(rows)
     }
-    return nil, fmt.Errorf("Account with number [%d] not found", number)
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return nil, errAccountNotFound(id)
 }
 
-func (s *PostgresStore) GetAccounts() ([]*Account, error) {
+func (s *PostgresStore) GetAccounts(ctx context.Context) ([]*Account, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
     // Fetching all rows from the account table 
-    rows, err := s.db.Query("SELECT * FROM account")
+    rows, err := s.db.QueryContext(ctx, "SELECT * FROM account")
     if err != nil {
         return nil, err
     }
+    defer rows.Close()
 
     // After fetching everything from the account table,
     // we need to move everything to the slice of account 
@@ -142,14 +327,1278 @@ func (s *PostgresStore) GetAccounts() ([]*Account, error) {
         }
         accounts = append(accounts, account)
     }
+    // A connection that breaks (or a deadline that runs out) halfway 
+    // through ends the loop just like the last row does
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return accounts, nil
+}
+
+// Transfer moves money from the account with the given ID into the account
+// with the given number. Everything happens inside a single SQL transaction so
+// either both balances change or neither of them does.
+func (s *PostgresStore) Transfer(ctx context.Context, fromID int, toNumber int64, amount int64) (*Transfer, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    if amount <= 0 {
+        return nil, ErrInvalidAmount
+    }
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    // Rollback is a no-op once the transaction has been committed, so it is
+    // safe to defer it right away and not worry about every early return.
+    defer tx.Rollback()
+
+    var toID int
+    err = tx.QueryRowContext(ctx, "SELECT id FROM account WHERE number = $1", toNumber).Scan(&toID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUnknownDestination
+    }
+    if err != nil {
+        return nil, err
+    }
+    if toID == fromID {
+        return nil, ErrSelfTransfer
+    }
+
+    entry := newTransferEntry(fromID, toID, amount)
+    accounts, err := postEntry(ctx, tx, entry)
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return newTransfer(entry, accounts), nil
+}
+
+func (s *PostgresStore) Deposit(ctx context.Context, accountID int, amount int64) (*JournalEntry, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    if amount <= 0 {
+        return nil, ErrInvalidAmount
+    }
+    return s.postSingleEntry(ctx, newDepositEntry(accountID, amount))
+}
+
+func (s *PostgresStore) Withdraw(ctx context.Context, accountID int, amount int64) (*JournalEntry, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    if amount <= 0 {
+        return nil, ErrInvalidAmount
+    }
+    return s.postSingleEntry(ctx, newWithdrawalEntry(accountID, amount))
+}
+
+func (s *PostgresStore) postSingleEntry(ctx context.Context, entry *JournalEntry) (*JournalEntry, error) {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    if _, err := postEntry(ctx, tx, entry); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return entry, nil
+}
+
+// postEntry writes a journal entry along with its postings and applies them
+// to the cached account balances. It has to run inside a transaction which the
+// caller is responsible for committing. The accounts that were touched are
+// returned (keyed by ID) with their balances after the entry.
+func postEntry(ctx context.Context, tx *sql.Tx, entry *JournalEntry) (map[int]*Account, error) {
+    if err := entry.Validate(); err != nil {
+        return nil, err
+    }
+
+    ids := []int64{}
+    for _, p := range entry.Postings {
+        if !isSystemAccount(p.AccountID) {
+            ids = append(ids, int64(p.AccountID))
+        }
+    }
+    // Lock every account row before touching them. The rows are always locked 
+    // in the order of their IDs, otherwise two opposite transfers running at 
+    // the same time (A -> B and B -> A) could deadlock each other.
+    rows, err := tx.QueryContext(ctx, `
+    SELECT id, number, balance FROM account 
+    WHERE id = ANY($1) 
+    ORDER BY id 
+    FOR UPDATE`, pq.Array(ids))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    accounts := map[int]*Account{}
+    for rows.Next() {
+        acc := new(Account)
+        if err := rows.Scan(&acc.ID, &acc.Number, &acc.Balance); err != nil {
+            return nil, err
+        }
+        accounts[acc.ID] = acc
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    // The rows have to be released before the next statement can be run on
+    // the same transaction.
+    rows.Close()
+
+    if err := applyPostings(entry, accounts); err != nil {
+        return nil, err
+    }
+
+    prev, err := lockChainHead(ctx, tx, "journal_entry", ledgerChainLock)
+    if err != nil {
+        return nil, err
+    }
+    entry.PostedAt = time.Now().UTC()
+    entry.seal(prev)
+    err = tx.QueryRowContext(ctx, 
+        "INSERT INTO journal_entry (kind, created_at, posted_at, hash) VALUES ($1, $2, $3, $4) RETURNING id",
+        entry.Kind,
+        entry.CreatedAt,
+        entry.PostedAt,
+        entry.Hash).Scan(&entry.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, p := range entry.Postings {
+        p.EntryID = entry.ID
+        // System accounts do not have a cached balance
+        balanceAfter := sql.NullInt64{
+            Int64: p.BalanceAfter, 
+            Valid: !isSystemAccount(p.AccountID),
+        }
+        query := `
+        INSERT INTO posting 
+        (entry_id, account_id, amount, balance_after)
+        VALUES 
+        ($1, $2, $3, $4)
+        RETURNING id`
+        err := tx.QueryRowContext(ctx, query, p.EntryID, p.AccountID, p.Amount, balanceAfter).Scan(&p.ID)
+        if err != nil {
+            return nil, err
+        }
+        if isSystemAccount(p.AccountID) {
+            continue
+        }
+        _, err = tx.ExecContext(ctx, 
+            "UPDATE account SET balance = $1 WHERE id = $2", 
+            p.BalanceAfter, 
+            p.AccountID)
+        if err != nil {
+            return nil, err
+        }
+    }
     return accounts, nil
 }
 
+// Keys of the advisory locks that serialise appending to the hash chains
+const (
+    ledgerChainLock = 7301
+    auditChainLock  = 7302
+)
+
+// Returning the hash at the end of a chain and keeping anybody else from 
+// appending to it until the transaction is over. Without the lock two 
+// transactions could link to the same record, and only one of them would end 
+// up being next in ID order. The lock is taken after the account rows are 
+// locked, so every transaction takes its locks in the same order.
+//
+// Waiting for the lock is where concurrent postings queue up, so it gets a
+// span of its own.
+func lockChainHead(ctx context.Context, tx *sql.Tx, table string, lock int64) (string, error) {
+    ctx, span := tracer().Start(ctx, "lockChainHead", trace.WithAttributes(attribute.String("db.collection.name", table)))
+    defer span.End()
+    if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", lock); err != nil {
+        return "", err
+    }
+    var prev string
+    err := tx.QueryRowContext(ctx, fmt.Sprintf(
+        "SELECT hash FROM %s WHERE hash IS NOT NULL ORDER BY id DESC LIMIT 1", table)).Scan(&prev)
+    if errors.Is(err, sql.ErrNoRows) {
+        return chainGenesis, nil
+    }
+    return prev, err
+}
+
+// CheckLedger proves (or disproves) that the books are balanced. All the 
+// queries run against the same snapshot so that transfers which get posted in 
+// the meantime cannot make a healthy ledger look broken.
+func (s *PostgresStore) CheckLedger(ctx context.Context) (*LedgerReport, error) {
+    // No deadline, this walks the whole table
+    ctx, span := startStoreSpan(ctx, "CheckLedger")
+    defer span.End()
+
+    tx, err := s.beginSnapshot(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    report := &LedgerReport{
+        UnbalancedEntries: []int64{},
+        Mismatches: []BalanceMismatch{},
+    }
+    err = tx.QueryRowContext(ctx, `
+    SELECT 
+        (SELECT COUNT(*) FROM journal_entry), 
+        COUNT(*), 
+        COALESCE(SUM(amount), 0) 
+    FROM posting`).Scan(&report.Entries, &report.Postings, &report.Total)
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := tx.QueryContext(ctx, `
+    SELECT entry_id FROM posting 
+    GROUP BY entry_id 
+    HAVING SUM(amount) <> 0 
+    ORDER BY entry_id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        report.UnbalancedEntries = append(report.UnbalancedEntries, id)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    rows.Close()
+
+    rows, err = tx.QueryContext(ctx, `
+    SELECT a.id, a.number, a.balance, COALESCE(SUM(p.amount), 0) 
+    FROM account a 
+    LEFT JOIN posting p ON p.account_id = a.id 
+    GROUP BY a.id, a.number, a.balance 
+    HAVING a.balance <> COALESCE(SUM(p.amount), 0) 
+    ORDER BY a.id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var m BalanceMismatch
+        if err := rows.Scan(&m.AccountID, &m.Number, &m.Balance, &m.PostingsSum); err != nil {
+            return nil, err
+        }
+        report.Mismatches = append(report.Mismatches, m)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return report, nil
+}
+
+// GetTransactions reads the history of an account from its postings, newest
+// first. The counterparty is looked up from the other posting of the same
+// journal entry, which only exists as an account for transfers.
+func (s *PostgresStore) GetTransactions(ctx context.Context, accountID int, q *TransactionQuery) (*TransactionPage, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    // The filters are optional so the WHERE clause is put together as we go.
+    // Only the placeholders end up in the query, the values are always sent 
+    // separately as arguments.
+    args := []any{accountID}
+    where := "p.account_id = $1"
+    addFilter := func(cond string, arg any) {
+        args = append(args, arg)
+        where += fmt.Sprintf(" AND "+cond, len(args))
+    }
+    if q.After != 0 {
+        addFilter("p.id < $%d", q.After)
+    }
+    if !q.From.IsZero() {
+        addFilter("e.posted_at >= $%d", q.From)
+    }
+    if !q.To.IsZero() {
+        addFilter("e.posted_at < $%d", q.To)
+    }
+    if q.Direction == DirectionCredit {
+        where += " AND p.amount > 0"
+    }
+    if q.Direction == DirectionDebit {
+        where += " AND p.amount < 0"
+    }
+    if q.Counterparty != 0 {
+        addFilter("cp.number = $%d", q.Counterparty)
+    }
+    if q.MinAmount != 0 {
+        addFilter("abs(p.amount) >= $%d", q.MinAmount)
+    }
+    if q.MaxAmount != 0 {
+        addFilter("abs(p.amount) <= $%d", q.MaxAmount)
+    }
+    args = append(args, q.Limit+1)
+
+    query := fmt.Sprintf(`
+    SELECT p.id, p.entry_id, e.kind, p.amount, COALESCE(p.balance_after, 0), e.posted_at, cp.number
+    FROM posting p
+    JOIN journal_entry e ON e.id = p.entry_id
+    LEFT JOIN LATERAL (
+        SELECT a.number FROM posting o 
+        JOIN account a ON a.id = o.account_id 
+        WHERE o.entry_id = p.entry_id AND o.id <> p.id 
+        LIMIT 1
+    ) cp ON true
+    WHERE %s
+    ORDER BY p.id DESC
+    LIMIT $%d`, where, len(args))
+
+    rows, err := s.db.QueryContext(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    txns := []*Transaction{}
+    for rows.Next() {
+        var (
+            p            Posting
+            kind         string
+            postedAt     time.Time
+            counterparty sql.NullInt64
+        )
+        err := rows.Scan(&p.ID, &p.EntryID, &kind, &p.Amount, &p.BalanceAfter, &postedAt, &counterparty)
+        if err != nil {
+            return nil, err
+        }
+        var cp *int64
+        if counterparty.Valid {
+            cp = &counterparty.Int64
+        }
+        txns = append(txns, newTransaction(&p, kind, postedAt, cp))
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return newTransactionPage(txns, q.Limit), nil
+}
+
+// ReserveIdempotencyKey claims a key for the request described by rec. If the
+// key has already been claimed (and has not expired) the existing record is
+// returned instead and nothing gets written.
+func (s *PostgresStore) ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    // Clearing out an expired record first, so that the insert below can 
+    // take its place. Both run as separate statements but the primary key 
+    // makes sure that only one of two racing requests wins the insert.
+    _, err := s.db.ExecContext(ctx, `
+    DELETE FROM idempotency_key 
+    WHERE key = $1 AND (created_at < $2 OR (status_code = 0 AND created_at < $3))`,
+        rec.Key,
+        rec.CreatedAt.Add(-idempotencyKeyTTL),
+        rec.CreatedAt.Add(-idempotencyLockTimeout))
+    if err != nil {
+        return nil, err
+    }
+
+    res, err := s.db.ExecContext(ctx, `
+    INSERT INTO idempotency_key (key, fingerprint, created_at) 
+    VALUES ($1, $2, $3) 
+    ON CONFLICT (key) DO NOTHING`, rec.Key, rec.Fingerprint, rec.CreatedAt)
+    if err != nil {
+        return nil, err
+    }
+    if n, err := res.RowsAffected(); err != nil || n == 1 {
+        return nil, err
+    }
+
+    existing := new(IdempotencyRecord)
+    err = s.db.QueryRowContext(ctx, `
+    SELECT key, fingerprint, status_code, body, created_at 
+    FROM idempotency_key WHERE key = $1`, rec.Key).Scan(
+        &existing.Key,
+        &existing.Fingerprint,
+        &existing.StatusCode,
+        &existing.Body,
+        &existing.CreatedAt)
+    if err != nil {
+        return nil, err
+    }
+    return existing, nil
+}
+
+func (s *PostgresStore) CompleteIdempotencyKey(ctx context.Context, key string, status int, body []byte) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    _, err := s.db.ExecContext(ctx, 
+        "UPDATE idempotency_key SET status_code = $1, body = $2 WHERE key = $3", 
+        status, 
+        body, 
+        key)
+    return err
+}
+
+func (s *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    _, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_key WHERE key = $1 AND status_code = 0", key)
+    return err
+}
+
+func (s *PostgresStore) CreateSession(ctx context.Context, session *Session, refresh *RefreshToken) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    _, err = tx.ExecContext(ctx, `
+    INSERT INTO session (id, account_id, created_at, expires_at) 
+    VALUES ($1, $2, $3, $4)`,
+        session.ID,
+        session.AccountID,
+        session.CreatedAt,
+        session.ExpiresAt)
+    if err != nil {
+        return err
+    }
+    if err := insertRefreshToken(ctx, tx, refresh); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func insertRefreshToken(ctx context.Context, tx *sql.Tx, refresh *RefreshToken) error {
+    _, err := tx.ExecContext(ctx, `
+    INSERT INTO refresh_token (token_hash, session_id, created_at, expires_at) 
+    VALUES ($1, $2, $3, $4)`,
+        refresh.TokenHash,
+        refresh.SessionID,
+        refresh.CreatedAt,
+        refresh.ExpiresAt)
+    return err
+}
+
+func (s *PostgresStore) GetSession(ctx context.Context, id string) (*Session, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    session := new(Session)
+    err := s.db.QueryRowContext(ctx, `
+    SELECT id, account_id, created_at, expires_at, revoked_at 
+    FROM session WHERE id = $1`, id).Scan(
+        &session.ID,
+        &session.AccountID,
+        &session.CreatedAt,
+        &session.ExpiresAt,
+        &session.RevokedAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrSessionNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return session, nil
+}
+
+// RotateRefreshToken trades in the refresh token with the given hash for the
+// next one, see checkRefreshToken for the rules. The old token is locked so 
+// that two concurrent refreshes with the same token cannot both succeed.
+func (s *PostgresStore) RotateRefreshToken(ctx context.Context, oldHash string, next *RefreshToken, now time.Time) (*Session, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    tok := new(RefreshToken)
+    session := new(Session)
+    err = tx.QueryRowContext(ctx, `
+    SELECT rt.token_hash, rt.session_id, rt.created_at, rt.expires_at, rt.used_at,
+           s.id, s.account_id, s.created_at, s.expires_at, s.revoked_at
+    FROM refresh_token rt 
+    JOIN session s ON s.id = rt.session_id 
+    WHERE rt.token_hash = $1 
+    FOR UPDATE`, oldHash).Scan(
+        &tok.TokenHash,
+        &tok.SessionID,
+        &tok.CreatedAt,
+        &tok.ExpiresAt,
+        &tok.UsedAt,
+        &session.ID,
+        &session.AccountID,
+        &session.CreatedAt,
+        &session.ExpiresAt,
+        &session.RevokedAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrInvalidRefreshToken
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if err := checkRefreshToken(tok, session, now); err != nil {
+        if errors.Is(err, ErrRefreshTokenReused) {
+            // The revocation has to be committed even though the refresh 
+            // itself fails.
+            _, revokeErr := tx.ExecContext(ctx, 
+                "UPDATE session SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", 
+                now, 
+                session.ID)
+            if revokeErr != nil {
+                return nil, revokeErr
+            }
+            if commitErr := tx.Commit(); commitErr != nil {
+                return nil, commitErr
+            }
+        }
+        return nil, err
+    }
+
+    _, err = tx.ExecContext(ctx, "UPDATE refresh_token SET used_at = $1 WHERE token_hash = $2", now, oldHash)
+    if err != nil {
+        return nil, err
+    }
+    next.SessionID = session.ID
+    if err := insertRefreshToken(ctx, tx, next); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return session, nil
+}
+
+func (s *PostgresStore) RevokeSession(ctx context.Context, id string, now time.Time) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    res, err := s.db.ExecContext(ctx, 
+        "UPDATE session SET revoked_at = COALESCE(revoked_at, $1) WHERE id = $2", 
+        now, 
+        id)
+    if err != nil {
+        return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrSessionNotFound
+    }
+    return nil
+}
+
+// Starting a TOTP setup. An unconfirmed setup gets replaced, a confirmed one
+// has to be disabled first.
+func (s *PostgresStore) SaveTOTP(ctx context.Context, t *TOTP) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    res, err := s.db.ExecContext(ctx, `
+    INSERT INTO account_totp (account_id, secret, created_at) 
+    VALUES ($1, $2, $3) 
+    ON CONFLICT (account_id) DO UPDATE 
+    SET secret = EXCLUDED.secret, created_at = EXCLUDED.created_at, last_step = 0 
+    WHERE account_totp.confirmed_at IS NULL`,
+        t.AccountID,
+        t.Secret,
+        t.CreatedAt)
+    var pqErr *pq.Error
+    if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+        return errAccountNotFound(t.AccountID)
+    }
+    if err != nil {
+        return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrTOTPAlreadyEnabled
+    }
+    return nil
+}
+
+func (s *PostgresStore) GetTOTP(ctx context.Context, accountID int) (*TOTP, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    t := new(TOTP)
+    err := s.db.QueryRowContext(ctx, `
+    SELECT account_id, secret, created_at, confirmed_at, last_step 
+    FROM account_totp WHERE account_id = $1`, accountID).Scan(
+        &t.AccountID,
+        &t.Secret,
+        &t.CreatedAt,
+        &t.ConfirmedAt,
+        &t.LastStep)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrTOTPNotEnrolled
+    }
+    if err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+// Turning TOTP on with the step of the code that confirmed it, any recovery 
+// codes of an earlier setup are replaced.
+func (s *PostgresStore) ConfirmTOTP(ctx context.Context, accountID int, step int64, recoveryHashes []string, now time.Time) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    res, err := tx.ExecContext(ctx, `
+    UPDATE account_totp SET confirmed_at = $1, last_step = $2 
+    WHERE account_id = $3 AND confirmed_at IS NULL`, now, step, accountID)
+    if err != nil {
+        return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        // Either there is nothing to confirm or somebody else was quicker.
+        // Asked on tx, the transaction is still holding its connection.
+        var exists int
+        err := tx.QueryRowContext(ctx, "SELECT 1 FROM account_totp WHERE account_id = $1", accountID).Scan(&exists)
+        if errors.Is(err, sql.ErrNoRows) {
+            return ErrTOTPNotEnrolled
+        }
+        if err != nil {
+            return err
+        }
+        return ErrTOTPAlreadyEnabled
+    }
+    if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_code WHERE account_id = $1", accountID); err != nil {
+        return err
+    }
+    _, err = tx.ExecContext(ctx, `
+    INSERT INTO recovery_code (account_id, code_hash) 
+    SELECT $1, unnest($2::text[])`, accountID, pq.Array(recoveryHashes))
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// Recording that a code of the given step has been used. Only steps after the
+// last used one are accepted, which also settles two logins racing with the 
+// same code.
+func (s *PostgresStore) UseTOTPStep(ctx context.Context, accountID int, step int64) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    res, err := s.db.ExecContext(ctx, `
+    UPDATE account_totp SET last_step = $1 
+    WHERE account_id = $2 AND last_step < $1`, step, accountID)
+    if err != nil {
+        return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrInvalidTOTPCode
+    }
+    return nil
+}
+
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, accountID int, codeHash string, now time.Time) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    res, err := s.db.ExecContext(ctx, `
+    UPDATE recovery_code SET used_at = $1 
+    WHERE account_id = $2 AND code_hash = $3 AND used_at IS NULL`, now, accountID, codeHash)
+    if err != nil {
+        return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrInvalidTOTPCode
+    }
+    return nil
+}
+
+// The recovery codes go with it (ON DELETE CASCADE)
+func (s *PostgresStore) DeleteTOTP(ctx context.Context, accountID int) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    res, err := s.db.ExecContext(ctx, "DELETE FROM account_totp WHERE account_id = $1", accountID)
+    if err != nil {
+        return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrTOTPNotEnrolled
+    }
+    return nil
+}
+
+func (s *PostgresStore) CreateLoginChallenge(ctx context.Context, c *LoginChallenge) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    _, err := s.db.ExecContext(ctx, `
+    INSERT INTO login_challenge (token_hash, account_id, created_at, expires_at) 
+    VALUES ($1, $2, $3, $4)`,
+        c.TokenHash,
+        c.AccountID,
+        c.CreatedAt,
+        c.ExpiresAt)
+    return err
+}
+
+// Counting an attempt against the challenge, see checkLoginChallenge. The 
+// conditions are part of the UPDATE so that concurrent attempts cannot get 
+// past the limit.
+func (s *PostgresStore) UseLoginChallenge(ctx context.Context, tokenHash string, now time.Time) (*LoginChallenge, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    c := new(LoginChallenge)
+    err := s.db.QueryRowContext(ctx, `
+    UPDATE login_challenge SET attempts = attempts + 1 
+    WHERE token_hash = $1 AND expires_at > $2 AND attempts < $3 
+    RETURNING token_hash, account_id, created_at, expires_at, attempts`, 
+        tokenHash, 
+        now, 
+        maxLoginChallengeAttempts).Scan(
+        &c.TokenHash,
+        &c.AccountID,
+        &c.CreatedAt,
+        &c.ExpiresAt,
+        &c.Attempts)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrInvalidLoginChallenge
+    }
+    if err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+func (s *PostgresStore) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    _, err := s.db.ExecContext(ctx, "DELETE FROM login_challenge WHERE token_hash = $1", tokenHash)
+    return err
+}
+
+// Counters that have never seen a failure do not have a row, they come back 
+// empty instead of as an error.
+func (s *PostgresStore) GetLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    t := &LoginThrottle{Key: key}
+    err := s.db.QueryRowContext(ctx, `
+    SELECT failures, last_failure_at, locked_until 
+    FROM login_throttle WHERE key = $1`, key).Scan(
+        &t.Failures,
+        &t.LastFailureAt,
+        &t.LockedUntil)
+    if errors.Is(err, sql.ErrNoRows) {
+        return t, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+// The row is locked while the failure gets applied, so that concurrent 
+// failures are all counted.
+func (s *PostgresStore) RecordLoginFailure(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (*LoginThrottle, bool, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, false, err
+    }
+    defer tx.Rollback()
+
+    _, err = tx.ExecContext(ctx, "INSERT INTO login_throttle (key) VALUES ($1) ON CONFLICT (key) DO NOTHING", key)
+    if err != nil {
+        return nil, false, err
+    }
+    t := &LoginThrottle{Key: key}
+    err = tx.QueryRowContext(ctx, `
+    SELECT failures, last_failure_at, locked_until 
+    FROM login_throttle WHERE key = $1 FOR UPDATE`, key).Scan(
+        &t.Failures,
+        &t.LastFailureAt,
+        &t.LockedUntil)
+    if err != nil {
+        return nil, false, err
+    }
+    locked := applyLoginFailure(t, policy, now)
+    _, err = tx.ExecContext(ctx, `
+    UPDATE login_throttle SET failures = $1, last_failure_at = $2, locked_until = $3 
+    WHERE key = $4`,
+        t.Failures,
+        t.LastFailureAt,
+        t.LockedUntil,
+        key)
+    if err != nil {
+        return nil, false, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, false, err
+    }
+    return t, locked, nil
+}
+
+func (s *PostgresStore) ResetLoginThrottle(ctx context.Context, key string) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    _, err := s.db.ExecContext(ctx, "DELETE FROM login_throttle WHERE key = $1", key)
+    return err
+}
+
+func (s *PostgresStore) CreateLockoutEvent(ctx context.Context, e *LockoutEvent) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    return s.db.QueryRowContext(ctx, `
+    INSERT INTO lockout_event 
+    (scope, action, account_number, ip, failures, locked_until, actor_number, created_at) 
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8) 
+    RETURNING id`,
+        e.Scope,
+        e.Action,
+        e.AccountNumber,
+        e.IP,
+        e.Failures,
+        e.LockedUntil,
+        e.ActorNumber,
+        e.CreatedAt).Scan(&e.ID)
+}
+
+func (s *PostgresStore) GetLockoutEvents(ctx context.Context, accountNumber int64) ([]*LockoutEvent, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    rows, err := s.db.QueryContext(ctx, `
+    SELECT id, scope, action, account_number, ip, failures, locked_until, actor_number, created_at 
+    FROM lockout_event WHERE account_number = $1 
+    ORDER BY id DESC`, accountNumber)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    events := []*LockoutEvent{}
+    for rows.Next() {
+        e := new(LockoutEvent)
+        err := rows.Scan(
+            &e.ID,
+            &e.Scope,
+            &e.Action,
+            &e.AccountNumber,
+            &e.IP,
+            &e.Failures,
+            &e.LockedUntil,
+            &e.ActorNumber,
+            &e.CreatedAt)
+        if err != nil {
+            return nil, err
+        }
+        events = append(events, e)
+    }
+    return events, rows.Err()
+}
+
+// Setting a new password and revoking every session of the account, in one 
+// transaction so that there is no window in which an old session survives 
+// the new password.
+func (s *PostgresStore) UpdatePassword(ctx context.Context, accountID int, encryptedPassword string, now time.Time) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if err := updatePassword(ctx, tx, accountID, encryptedPassword, now); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func updatePassword(ctx context.Context, tx *sql.Tx, accountID int, encryptedPassword string, now time.Time) error {
+    res, err := tx.ExecContext(ctx, "UPDATE account SET encrypted_password = $1 WHERE id = $2", encryptedPassword, accountID)
+    if err != nil {
+        return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return errAccountNotFound(accountID)
+    }
+    _, err = tx.ExecContext(ctx, 
+        "UPDATE session SET revoked_at = $1 WHERE account_id = $2 AND revoked_at IS NULL", 
+        now, 
+        accountID)
+    return err
+}
+
+// Swapping the hash of the same password for a stronger one, which unlike 
+// UpdatePassword leaves the sessions alone. Only replaces oldHash, if the 
+// password has been changed in the meantime the new password wins.
+func (s *PostgresStore) UpdatePasswordHash(ctx context.Context, accountID int, oldHash, newHash string) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    _, err := s.db.ExecContext(ctx, 
+        "UPDATE account SET encrypted_password = $1 WHERE id = $2 AND encrypted_password = $3", 
+        newHash, 
+        accountID, 
+        oldHash)
+    return err
+}
+
+func (s *PostgresStore) CreatePasswordReset(ctx context.Context, p *PasswordReset) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    _, err := s.db.ExecContext(ctx, `
+    INSERT INTO password_reset (token_hash, account_id, created_at, expires_at) 
+    VALUES ($1, $2, $3, $4)`,
+        p.TokenHash,
+        p.AccountID,
+        p.CreatedAt,
+        p.ExpiresAt)
+    return err
+}
+
+// Using up a reset token and setting the new password, see 
+// checkPasswordReset for the rules. Returns the ID of the account.
+func (s *PostgresStore) ResetPassword(ctx context.Context, tokenHash string, encryptedPassword string, now time.Time) (int, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    var accountID int
+    err = tx.QueryRowContext(ctx, `
+    UPDATE password_reset SET used_at = $1 
+    WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1 
+    RETURNING account_id`, now, tokenHash).Scan(&accountID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return 0, ErrInvalidResetToken
+    }
+    if err != nil {
+        return 0, err
+    }
+    if err := updatePassword(ctx, tx, accountID, encryptedPassword, now); err != nil {
+        return 0, err
+    }
+    return accountID, tx.Commit()
+}
+
+// Audit records only ever get inserted, the table has triggers which reject 
+// anything else.
+func (s *PostgresStore) AppendAudit(ctx context.Context, rec *AuditRecord) error {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    prev, err := lockChainHead(ctx, tx, "audit_log", auditChainLock)
+    if err != nil {
+        return err
+    }
+    rec.seal(prev)
+    err = tx.QueryRowContext(ctx, `
+    INSERT INTO audit_log 
+    (action, actor_number, actor_role, target_number, request_id, ip, before, after, created_at, hash) 
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) 
+    RETURNING id`,
+        rec.Action,
+        rec.ActorNumber,
+        rec.ActorRole,
+        rec.TargetNumber,
+        rec.RequestID,
+        rec.IP,
+        nullJSON(rec.Before),
+        nullJSON(rec.After),
+        rec.CreatedAt,
+        rec.Hash).Scan(&rec.ID)
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// lib/pq would send a []byte as bytea, JSON columns want text
+func nullJSON(raw []byte) any {
+    if len(raw) == 0 {
+        return nil
+    }
+    return string(raw)
+}
+
+func (s *PostgresStore) GetAuditRecords(ctx context.Context, q *AuditQuery) (*AuditPage, error) {
+    ctx, done := s.operation(ctx)
+    defer done()
+
+    args := []any{}
+    where := "true"
+    addFilter := func(cond string, arg any) {
+        args = append(args, arg)
+        where += fmt.Sprintf(" AND "+cond, len(args))
+    }
+    if q.After != 0 {
+        addFilter("id < $%d", q.After)
+    }
+    if q.Action != "" {
+        addFilter("action = $%d", q.Action)
+    }
+    if q.Actor != 0 {
+        addFilter("actor_number = $%d", q.Actor)
+    }
+    if q.Target != 0 {
+        addFilter("target_number = $%d", q.Target)
+    }
+    if q.RequestID != "" {
+        addFilter("request_id = $%d", q.RequestID)
+    }
+    if !q.From.IsZero() {
+        addFilter("created_at >= $%d", q.From)
+    }
+    if !q.To.IsZero() {
+        addFilter("created_at < $%d", q.To)
+    }
+    args = append(args, q.Limit+1)
+
+    query := fmt.Sprintf(`
+    SELECT id, action, actor_number, actor_role, target_number, request_id, ip, before, after, created_at, COALESCE(hash, '') 
+    FROM audit_log 
+    WHERE %s 
+    ORDER BY id DESC 
+    LIMIT $%d`, where, len(args))
+
+    rows, err := s.db.QueryContext(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    records := []*AuditRecord{}
+    for rows.Next() {
+        rec := new(AuditRecord)
+        var before, after []byte
+        err := rows.Scan(
+            &rec.ID,
+            &rec.Action,
+            &rec.ActorNumber,
+            &rec.ActorRole,
+            &rec.TargetNumber,
+            &rec.RequestID,
+            &rec.IP,
+            &before,
+            &after,
+            &rec.CreatedAt,
+            &rec.Hash)
+        if err != nil {
+            return nil, err
+        }
+        rec.Before, rec.After = before, after
+        records = append(records, rec)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return newAuditPage(records, q.Limit), nil
+}
+
+// A read only snapshot for checks that look at a lot of rows, records that 
+// get written in the meantime are simply not part of it.
+func (s *PostgresStore) beginSnapshot(ctx context.Context) (*sql.Tx, error) {
+    return s.db.BeginTx(ctx, &sql.TxOptions{
+        Isolation: sql.LevelRepeatableRead,
+        ReadOnly: true,
+    })
+}
+
+func (s *PostgresStore) VerifyLedgerChain(ctx context.Context) (*ChainReport, error) {
+    // No deadline, this walks the whole table
+    ctx, span := startStoreSpan(ctx, "VerifyLedgerChain")
+    defer span.End()
+
+    tx, err := s.beginSnapshot(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    // One row per posting, an entry whose postings were deleted still shows 
+    // up once (and then fails to match its hash).
+    rows, err := tx.QueryContext(ctx, `
+    SELECT e.id, e.kind, e.created_at, e.posted_at, COALESCE(e.hash, ''), 
+        p.account_id, p.amount, COALESCE(p.balance_after, 0) 
+    FROM journal_entry e 
+    LEFT JOIN posting p ON p.entry_id = e.id 
+    ORDER BY e.id, p.id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    w := newChainWalker(ChainLedger)
+    var entry *JournalEntry
+    intact := true
+    for rows.Next() {
+        var (
+            e                    JournalEntry
+            accountID            sql.NullInt64
+            amount, balanceAfter int64
+        )
+        err := rows.Scan(&e.ID, &e.Kind, &e.CreatedAt, &e.PostedAt, &e.Hash, &accountID, &amount, &balanceAfter)
+        if err != nil {
+            return nil, err
+        }
+        if entry == nil || entry.ID != e.ID {
+            if entry != nil {
+                if intact = w.next(entry.ID, entry.Hash, entry.chainHash); !intact {
+                    break
+                }
+            }
+            entry = &e
+        }
+        if accountID.Valid {
+            entry.Postings = append(entry.Postings, &Posting{
+                AccountID: int(accountID.Int64),
+                Amount: amount,
+                BalanceAfter: balanceAfter,
+            })
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if intact && entry != nil {
+        w.next(entry.ID, entry.Hash, entry.chainHash)
+    }
+    return w.report, nil
+}
+
+func (s *PostgresStore) VerifyAuditChain(ctx context.Context) (*ChainReport, error) {
+    // No deadline, this walks the whole table
+    ctx, span := startStoreSpan(ctx, "VerifyAuditChain")
+    defer span.End()
+
+    tx, err := s.beginSnapshot(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, `
+    SELECT id, action, actor_number, actor_role, target_number, request_id, ip, before, after, created_at, COALESCE(hash, '') 
+    FROM audit_log 
+    ORDER BY id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    w := newChainWalker(ChainAuditLog)
+    for rows.Next() {
+        rec := new(AuditRecord)
+        var before, after []byte
+        err := rows.Scan(
+            &rec.ID,
+            &rec.Action,
+            &rec.ActorNumber,
+            &rec.ActorRole,
+            &rec.TargetNumber,
+            &rec.RequestID,
+            &rec.IP,
+            &before,
+            &after,
+            &rec.CreatedAt,
+            &rec.Hash)
+        if err != nil {
+            return nil, err
+        }
+        rec.Before, rec.After = before, after
+        if !w.next(rec.ID, rec.Hash, rec.chainHash) {
+            break
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return w.report, nil
+}
+
+// Either a *sql.Row or *sql.Rows
+type rowScanner interface {
+    Scan(dest ...any) error
+}
+
 // -- HELPER FUNCTION 
 // Useful for getting things from SQL rows 
 // and moving them into Account struct and returning a pointer.
 // Will be useful in other functions as well.
-func scanIntoAccount(rows *sql.Rows) (*Account, error){
+func scanIntoAccount(rows rowScanner) (*Account, error){
     account := new(Account)
     err := rows.Scan(
         &account.ID,
@@ -158,7 +1607,8 @@ func scanIntoAccount(rows *sql.Rows) (*Account, error){
         &account.Number,
         &account.EncryptedPassword,
         &account.Balance,
-        &account.CreatedAt)
+        &account.CreatedAt,
+        &account.Role)
     if err != nil {
         return nil, err
     }
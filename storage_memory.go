@@ -0,0 +1,744 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "sort"
+    "sync"
+    "time"
+)
+
+// MemoryStore keeps everything in maps guarded by a single lock. It exists so
+// that the server (and the tests) can run without a PostgreSQL database, and
+// it must behave exactly like PostgresStore: same errors, same IDs being
+// handed out, same ledger rules. Nothing survives a restart.
+type MemoryStore struct {
+    mu sync.RWMutex
+
+    accounts      map[int]*Account
+    numbers       map[int64]int
+    nextAccountID int
+
+    entries       []*JournalEntry
+    nextEntryID   int64
+    nextPostingID int64
+
+    idempotency map[string]*IdempotencyRecord
+
+    sessions      map[string]*Session
+    refreshTokens map[string]*RefreshToken
+
+    totp            map[int]*TOTP
+    recoveryCodes   map[int]map[string]*time.Time
+    loginChallenges map[string]*LoginChallenge
+
+    loginThrottles map[string]*LoginThrottle
+    lockoutEvents  []*LockoutEvent
+
+    passwordResets map[string]*PasswordReset
+
+    auditLog []*AuditRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        accounts: map[int]*Account{},
+        numbers: map[int64]int{},
+        idempotency: map[string]*IdempotencyRecord{},
+        sessions: map[string]*Session{},
+        refreshTokens: map[string]*RefreshToken{},
+        totp: map[int]*TOTP{},
+        recoveryCodes: map[int]map[string]*time.Time{},
+        loginChallenges: map[string]*LoginChallenge{},
+        loginThrottles: map[string]*LoginThrottle{},
+        passwordResets: map[string]*PasswordReset{},
+    }
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+    return nil
+}
+
+// Nothing to release, everything is simply forgotten
+func (s *MemoryStore) Close() error {
+    return nil
+}
+
+// Handing out copies so that callers can never change what is stored without
+// going through the store, the same way a row read from PostgreSQL is a copy.
+func copyAccount(acc *Account) *Account {
+    c := *acc
+    return &c
+}
+
+func (s *MemoryStore) CreateAccount(ctx context.Context, acc *Account) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.numbers[acc.Number]; ok {
+        return ErrAccountNumberTaken
+    }
+    s.nextAccountID++
+    acc.ID = s.nextAccountID
+    s.accounts[acc.ID] = copyAccount(acc)
+    s.numbers[acc.Number] = acc.ID
+    return nil
+}
+
+func (s *MemoryStore) DeleteAccount(ctx context.Context, id int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    acc, ok := s.accounts[id]
+    if !ok {
+        return errAccountNotFound(id)
+    }
+    if acc.Balance != 0 {
+        return ErrAccountNotEmpty
+    }
+    delete(s.numbers, acc.Number)
+    delete(s.accounts, id)
+    // Same as ON DELETE CASCADE for sessions and their refresh tokens
+    for sid, session := range s.sessions {
+        if session.AccountID == id {
+            delete(s.sessions, sid)
+        }
+    }
+    for hash, tok := range s.refreshTokens {
+        if _, ok := s.sessions[tok.SessionID]; !ok {
+            delete(s.refreshTokens, hash)
+        }
+    }
+    delete(s.totp, id)
+    delete(s.recoveryCodes, id)
+    for hash, c := range s.loginChallenges {
+        if c.AccountID == id {
+            delete(s.loginChallenges, hash)
+        }
+    }
+    for hash, p := range s.passwordResets {
+        if p.AccountID == id {
+            delete(s.passwordResets, hash)
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) GetAccounts(ctx context.Context) ([]*Account, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    accounts := []*Account{}
+    for _, acc := range s.accounts {
+        accounts = append(accounts, copyAccount(acc))
+    }
+    sort.Slice(accounts, func(i, j int) bool {
+        return accounts[i].ID < accounts[j].ID
+    })
+    return accounts, nil
+}
+
+func (s *MemoryStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    acc, ok := s.accounts[id]
+    if !ok {
+        return nil, errAccountNotFound(id)
+    }
+    return copyAccount(acc), nil
+}
+
+func (s *MemoryStore) GetAccountByNumber(ctx context.Context, number int) (*Account, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    id, ok := s.numbers[int64(number)]
+    if !ok {
+        return nil, errAccountNumberNotFound(number)
+    }
+    return copyAccount(s.accounts[id]), nil
+}
+
+func (s *MemoryStore) UpdateAccountRole(ctx context.Context, id int, role string) (*Account, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    acc, ok := s.accounts[id]
+    if !ok {
+        return nil, errAccountNotFound(id)
+    }
+    acc.Role = role
+    return copyAccount(acc), nil
+}
+
+func (s *MemoryStore) Transfer(ctx context.Context, fromID int, toNumber int64, amount int64) (*Transfer, error) {
+    if amount <= 0 {
+        return nil, ErrInvalidAmount
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    toID, ok := s.numbers[toNumber]
+    if !ok {
+        return nil, ErrUnknownDestination
+    }
+    if toID == fromID {
+        return nil, ErrSelfTransfer
+    }
+
+    entry := newTransferEntry(fromID, toID, amount)
+    accounts, err := s.postEntry(entry)
+    if err != nil {
+        return nil, err
+    }
+    return newTransfer(entry, accounts), nil
+}
+
+func (s *MemoryStore) Deposit(ctx context.Context, accountID int, amount int64) (*JournalEntry, error) {
+    if amount <= 0 {
+        return nil, ErrInvalidAmount
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    entry := newDepositEntry(accountID, amount)
+    if _, err := s.postEntry(entry); err != nil {
+        return nil, err
+    }
+    return entry, nil
+}
+
+func (s *MemoryStore) Withdraw(ctx context.Context, accountID int, amount int64) (*JournalEntry, error) {
+    if amount <= 0 {
+        return nil, ErrInvalidAmount
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    entry := newWithdrawalEntry(accountID, amount)
+    if _, err := s.postEntry(entry); err != nil {
+        return nil, err
+    }
+    return entry, nil
+}
+
+// The in-memory version of postEntry in storage.go. The postings are applied
+// to copies of the accounts first so that a failing entry leaves nothing
+// behind, which is what the rollback does for PostgreSQL. Callers must hold
+// the write lock.
+func (s *MemoryStore) postEntry(entry *JournalEntry) (map[int]*Account, error) {
+    if err := entry.Validate(); err != nil {
+        return nil, err
+    }
+    accounts := map[int]*Account{}
+    for _, p := range entry.Postings {
+        if acc, ok := s.accounts[p.AccountID]; ok {
+            accounts[acc.ID] = copyAccount(acc)
+        }
+    }
+    if err := applyPostings(entry, accounts); err != nil {
+        return nil, err
+    }
+
+    prev := chainGenesis
+    if n := len(s.entries); n > 0 && s.entries[n-1].Hash != "" {
+        prev = s.entries[n-1].Hash
+    }
+    s.nextEntryID++
+    entry.ID = s.nextEntryID
+    entry.PostedAt = time.Now().UTC()
+    entry.seal(prev)
+    for _, p := range entry.Postings {
+        s.nextPostingID++
+        p.ID = s.nextPostingID
+        p.EntryID = entry.ID
+    }
+    for id, acc := range accounts {
+        s.accounts[id].Balance = acc.Balance
+    }
+    s.entries = append(s.entries, entry)
+    return accounts, nil
+}
+
+func (s *MemoryStore) CheckLedger(ctx context.Context) (*LedgerReport, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    report := &LedgerReport{
+        UnbalancedEntries: []int64{},
+        Mismatches: []BalanceMismatch{},
+    }
+    sums := map[int]int64{}
+    for _, e := range s.entries {
+        report.Entries++
+        var entrySum int64
+        for _, p := range e.Postings {
+            report.Postings++
+            report.Total += p.Amount
+            entrySum += p.Amount
+            sums[p.AccountID] += p.Amount
+        }
+        if entrySum != 0 {
+            report.UnbalancedEntries = append(report.UnbalancedEntries, e.ID)
+        }
+    }
+    for _, acc := range s.accounts {
+        if acc.Balance != sums[acc.ID] {
+            report.Mismatches = append(report.Mismatches, BalanceMismatch{
+                AccountID: acc.ID,
+                Number: acc.Number,
+                Balance: acc.Balance,
+                PostingsSum: sums[acc.ID],
+            })
+        }
+    }
+    sort.Slice(report.Mismatches, func(i, j int) bool {
+        return report.Mismatches[i].AccountID < report.Mismatches[j].AccountID
+    })
+    return report, nil
+}
+
+func (s *MemoryStore) VerifyLedgerChain(ctx context.Context) (*ChainReport, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    w := newChainWalker(ChainLedger)
+    for _, e := range s.entries {
+        if !w.next(e.ID, e.Hash, e.chainHash) {
+            break
+        }
+    }
+    return w.report, nil
+}
+
+func (s *MemoryStore) GetTransactions(ctx context.Context, accountID int, q *TransactionQuery) (*TransactionPage, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    // Walking the journal backwards gives us the postings newest first, the
+    // same order as ORDER BY p.id DESC.
+    txns := []*Transaction{}
+    for i := len(s.entries) - 1; i >= 0 && len(txns) <= q.Limit; i-- {
+        e := s.entries[i]
+        for j := len(e.Postings) - 1; j >= 0; j-- {
+            p := e.Postings[j]
+            if p.AccountID != accountID || (q.After != 0 && p.ID >= q.After) {
+                continue
+            }
+            t := newTransaction(p, e.Kind, e.PostedAt, s.counterparty(e, p))
+            if q.Matches(t) && len(txns) <= q.Limit {
+                txns = append(txns, t)
+            }
+        }
+    }
+    return newTransactionPage(txns, q.Limit), nil
+}
+
+// Account number of the other side of a posting, if that is a customer
+// account which still exists.
+func (s *MemoryStore) counterparty(e *JournalEntry, p *Posting) *int64 {
+    for _, o := range e.Postings {
+        if o.ID == p.ID {
+            continue
+        }
+        if acc, ok := s.accounts[o.AccountID]; ok {
+            number := acc.Number
+            return &number
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if existing, ok := s.idempotency[rec.Key]; ok && !existing.Expired(rec.CreatedAt) {
+        c := *existing
+        return &c, nil
+    }
+    c := *rec
+    s.idempotency[rec.Key] = &c
+    return nil, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(ctx context.Context, key string, status int, body []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if rec, ok := s.idempotency[key]; ok {
+        rec.StatusCode = status
+        rec.Body = append([]byte(nil), body...)
+    }
+    return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if rec, ok := s.idempotency[key]; ok && !rec.Completed() {
+        delete(s.idempotency, key)
+    }
+    return nil
+}
+
+func (s *MemoryStore) CreateSession(ctx context.Context, session *Session, refresh *RefreshToken) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.accounts[session.AccountID]; !ok {
+        return errAccountNotFound(session.AccountID)
+    }
+    sc := *session
+    rc := *refresh
+    s.sessions[sc.ID] = &sc
+    s.refreshTokens[rc.TokenHash] = &rc
+    return nil
+}
+
+func (s *MemoryStore) GetSession(ctx context.Context, id string) (*Session, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    session, ok := s.sessions[id]
+    if !ok {
+        return nil, ErrSessionNotFound
+    }
+    c := *session
+    return &c, nil
+}
+
+func (s *MemoryStore) RotateRefreshToken(ctx context.Context, oldHash string, next *RefreshToken, now time.Time) (*Session, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    tok, ok := s.refreshTokens[oldHash]
+    if !ok {
+        return nil, ErrInvalidRefreshToken
+    }
+    session := s.sessions[tok.SessionID]
+    if err := checkRefreshToken(tok, session, now); err != nil {
+        if errors.Is(err, ErrRefreshTokenReused) && session.RevokedAt == nil {
+            revokedAt := now
+            session.RevokedAt = &revokedAt
+        }
+        return nil, err
+    }
+
+    usedAt := now
+    tok.UsedAt = &usedAt
+    next.SessionID = session.ID
+    nc := *next
+    s.refreshTokens[nc.TokenHash] = &nc
+    c := *session
+    return &c, nil
+}
+
+func (s *MemoryStore) RevokeSession(ctx context.Context, id string, now time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    session, ok := s.sessions[id]
+    if !ok {
+        return ErrSessionNotFound
+    }
+    if session.RevokedAt == nil {
+        revokedAt := now
+        session.RevokedAt = &revokedAt
+    }
+    return nil
+}
+
+func (s *MemoryStore) SaveTOTP(ctx context.Context, t *TOTP) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.accounts[t.AccountID]; !ok {
+        return errAccountNotFound(t.AccountID)
+    }
+    if existing, ok := s.totp[t.AccountID]; ok && existing.Enabled() {
+        return ErrTOTPAlreadyEnabled
+    }
+    c := *t
+    c.ConfirmedAt = nil
+    c.LastStep = 0
+    s.totp[t.AccountID] = &c
+    return nil
+}
+
+func (s *MemoryStore) GetTOTP(ctx context.Context, accountID int) (*TOTP, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    t, ok := s.totp[accountID]
+    if !ok {
+        return nil, ErrTOTPNotEnrolled
+    }
+    c := *t
+    return &c, nil
+}
+
+func (s *MemoryStore) ConfirmTOTP(ctx context.Context, accountID int, step int64, recoveryHashes []string, now time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    t, ok := s.totp[accountID]
+    if !ok {
+        return ErrTOTPNotEnrolled
+    }
+    if t.Enabled() {
+        return ErrTOTPAlreadyEnabled
+    }
+    confirmedAt := now
+    t.ConfirmedAt = &confirmedAt
+    t.LastStep = step
+    codes := map[string]*time.Time{}
+    for _, hash := range recoveryHashes {
+        codes[hash] = nil
+    }
+    s.recoveryCodes[accountID] = codes
+    return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(ctx context.Context, accountID int, step int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    t, ok := s.totp[accountID]
+    if !ok || step <= t.LastStep {
+        return ErrInvalidTOTPCode
+    }
+    t.LastStep = step
+    return nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, accountID int, codeHash string, now time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    usedAt, ok := s.recoveryCodes[accountID][codeHash]
+    if !ok || usedAt != nil {
+        return ErrInvalidTOTPCode
+    }
+    used := now
+    s.recoveryCodes[accountID][codeHash] = &used
+    return nil
+}
+
+func (s *MemoryStore) DeleteTOTP(ctx context.Context, accountID int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.totp[accountID]; !ok {
+        return ErrTOTPNotEnrolled
+    }
+    delete(s.totp, accountID)
+    delete(s.recoveryCodes, accountID)
+    return nil
+}
+
+func (s *MemoryStore) CreateLoginChallenge(ctx context.Context, c *LoginChallenge) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.accounts[c.AccountID]; !ok {
+        return errAccountNotFound(c.AccountID)
+    }
+    cc := *c
+    s.loginChallenges[cc.TokenHash] = &cc
+    return nil
+}
+
+func (s *MemoryStore) UseLoginChallenge(ctx context.Context, tokenHash string, now time.Time) (*LoginChallenge, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    c, ok := s.loginChallenges[tokenHash]
+    if !ok {
+        return nil, ErrInvalidLoginChallenge
+    }
+    if err := checkLoginChallenge(c, now); err != nil {
+        return nil, err
+    }
+    c.Attempts++
+    cc := *c
+    return &cc, nil
+}
+
+func (s *MemoryStore) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.loginChallenges, tokenHash)
+    return nil
+}
+
+func (s *MemoryStore) GetLoginThrottle(ctx context.Context, key string) (*LoginThrottle, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    t, ok := s.loginThrottles[key]
+    if !ok {
+        return &LoginThrottle{Key: key}, nil
+    }
+    c := *t
+    return &c, nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (*LoginThrottle, bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    t, ok := s.loginThrottles[key]
+    if !ok {
+        t = &LoginThrottle{Key: key}
+        s.loginThrottles[key] = t
+    }
+    locked := applyLoginFailure(t, policy, now)
+    c := *t
+    return &c, locked, nil
+}
+
+func (s *MemoryStore) ResetLoginThrottle(ctx context.Context, key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.loginThrottles, key)
+    return nil
+}
+
+func (s *MemoryStore) CreateLockoutEvent(ctx context.Context, e *LockoutEvent) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e.ID = int64(len(s.lockoutEvents) + 1)
+    c := *e
+    s.lockoutEvents = append(s.lockoutEvents, &c)
+    return nil
+}
+
+func (s *MemoryStore) GetLockoutEvents(ctx context.Context, accountNumber int64) ([]*LockoutEvent, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    events := []*LockoutEvent{}
+    for i := len(s.lockoutEvents) - 1; i >= 0; i-- {
+        if e := s.lockoutEvents[i]; e.AccountNumber == accountNumber {
+            c := *e
+            events = append(events, &c)
+        }
+    }
+    return events, nil
+}
+
+func (s *MemoryStore) UpdatePassword(ctx context.Context, accountID int, encryptedPassword string, now time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.updatePassword(accountID, encryptedPassword, now)
+}
+
+// Callers must hold the write lock
+func (s *MemoryStore) updatePassword(accountID int, encryptedPassword string, now time.Time) error {
+    acc, ok := s.accounts[accountID]
+    if !ok {
+        return errAccountNotFound(accountID)
+    }
+    acc.EncryptedPassword = encryptedPassword
+    for _, session := range s.sessions {
+        if session.AccountID == accountID && session.RevokedAt == nil {
+            revokedAt := now
+            session.RevokedAt = &revokedAt
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) UpdatePasswordHash(ctx context.Context, accountID int, oldHash, newHash string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if acc, ok := s.accounts[accountID]; ok && acc.EncryptedPassword == oldHash {
+        acc.EncryptedPassword = newHash
+    }
+    return nil
+}
+
+func (s *MemoryStore) CreatePasswordReset(ctx context.Context, p *PasswordReset) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.accounts[p.AccountID]; !ok {
+        return errAccountNotFound(p.AccountID)
+    }
+    c := *p
+    s.passwordResets[c.TokenHash] = &c
+    return nil
+}
+
+func (s *MemoryStore) ResetPassword(ctx context.Context, tokenHash string, encryptedPassword string, now time.Time) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    p, ok := s.passwordResets[tokenHash]
+    if !ok {
+        return 0, ErrInvalidResetToken
+    }
+    if err := checkPasswordReset(p, now); err != nil {
+        return 0, err
+    }
+    if err := s.updatePassword(p.AccountID, encryptedPassword, now); err != nil {
+        return 0, err
+    }
+    usedAt := now
+    p.UsedAt = &usedAt
+    return p.AccountID, nil
+}
+
+func (s *MemoryStore) AppendAudit(ctx context.Context, rec *AuditRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    prev := chainGenesis
+    if n := len(s.auditLog); n > 0 && s.auditLog[n-1].Hash != "" {
+        prev = s.auditLog[n-1].Hash
+    }
+    rec.ID = int64(len(s.auditLog) + 1)
+    rec.seal(prev)
+    c := *rec
+    s.auditLog = append(s.auditLog, &c)
+    return nil
+}
+
+func (s *MemoryStore) GetAuditRecords(ctx context.Context, q *AuditQuery) (*AuditPage, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    records := []*AuditRecord{}
+    for i := len(s.auditLog) - 1; i >= 0 && len(records) <= q.Limit; i-- {
+        rec := s.auditLog[i]
+        if q.After != 0 && rec.ID >= q.After {
+            continue
+        }
+        if q.Matches(rec) {
+            c := *rec
+            records = append(records, &c)
+        }
+    }
+    return newAuditPage(records, q.Limit), nil
+}
+
+func (s *MemoryStore) VerifyAuditChain(ctx context.Context) (*ChainReport, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    w := newChainWalker(ChainAuditLog)
+    for _, rec := range s.auditLog {
+        if !w.next(rec.ID, rec.Hash, rec.chainHash) {
+            break
+        }
+    }
+    return w.report, nil
+}
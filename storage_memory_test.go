@@ -0,0 +1,162 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+// The context for calling the stores directly
+var ctx = context.Background()
+
+// Creating an account straight in the store, skipping the password hashing
+// of NewAccount which only slows the tests down.
+func newTestAccount(t *testing.T, s Storage, number int64, balance int64) *Account {
+    acc := &Account{FirstName: "a", LastName: "b", Number: number, Role: RoleCustomer, CreatedAt: time.Now().UTC()}
+    assert.Nil(t, s.CreateAccount(ctx, acc))
+    if balance > 0 {
+        _, err := s.Deposit(ctx, acc.ID, balance)
+        assert.Nil(t, err)
+    }
+    return acc
+}
+
+func TestMemoryStoreAccounts(t *testing.T){
+    s := NewMemoryStore()
+    acc := newTestAccount(t, s, 123456, 0)
+    assert.Equal(t, 1, acc.ID)
+
+    dup := &Account{Number: 123456}
+    assert.ErrorIs(t, s.CreateAccount(ctx, dup), ErrAccountNumberTaken)
+
+    got, err := s.GetAccountByNumber(ctx, 123456)
+    assert.Nil(t, err)
+    assert.Equal(t, acc.ID, got.ID)
+
+    // Changing what we got back must not change what is stored
+    got.Balance = 1000
+    got, _ = s.GetAccountByID(ctx, acc.ID)
+    assert.Equal(t, int64(0), got.Balance)
+
+    assert.Nil(t, s.DeleteAccount(ctx, acc.ID))
+    _, err = s.GetAccountByID(ctx, acc.ID)
+    assert.EqualError(t, err, "account 1 not found")
+    _, err = s.GetAccountByNumber(ctx, 123456)
+    assert.EqualError(t, err, "Account with number [123456] not found")
+    assert.EqualError(t, s.DeleteAccount(ctx, acc.ID), "account 1 not found")
+}
+
+// Deleting an account with money in it would take the money out of every
+// balance while its postings stay in the ledger
+func TestMemoryStoreDeleteFundedAccount(t *testing.T){
+    s := NewMemoryStore()
+    acc := newTestAccount(t, s, 123456, 100)
+
+    assert.ErrorIs(t, s.DeleteAccount(ctx, acc.ID), ErrAccountNotEmpty)
+    _, err := s.GetAccountByID(ctx, acc.ID)
+    assert.Nil(t, err)
+    report, err := s.CheckLedger(ctx)
+    assert.Nil(t, err)
+    assert.True(t, report.Balanced())
+
+    // Once it has been paid out it can go
+    _, err = s.Withdraw(ctx, acc.ID, 100)
+    assert.Nil(t, err)
+    assert.Nil(t, s.DeleteAccount(ctx, acc.ID))
+    report, err = s.CheckLedger(ctx)
+    assert.Nil(t, err)
+    assert.True(t, report.Balanced())
+}
+
+func TestMemoryStoreTransfer(t *testing.T){
+    s := NewMemoryStore()
+    from := newTestAccount(t, s, 111111, 100)
+    to := newTestAccount(t, s, 222222, 0)
+
+    transfer, err := s.Transfer(ctx, from.ID, to.Number, 30)
+    assert.Nil(t, err)
+    assert.Equal(t, int64(70), transfer.FromBalance)
+    assert.Equal(t, int64(30), transfer.ToBalance)
+
+    _, err = s.Transfer(ctx, from.ID, to.Number, 71)
+    assert.ErrorIs(t, err, ErrInsufficientFunds)
+    _, err = s.Transfer(ctx, from.ID, from.Number, 10)
+    assert.ErrorIs(t, err, ErrSelfTransfer)
+    _, err = s.Transfer(ctx, from.ID, 999999, 10)
+    assert.ErrorIs(t, err, ErrUnknownDestination)
+    _, err = s.Transfer(ctx, from.ID, to.Number, 0)
+    assert.ErrorIs(t, err, ErrInvalidAmount)
+
+    // The failed transfers must not have left anything behind
+    acc, _ := s.GetAccountByID(ctx, from.ID)
+    assert.Equal(t, int64(70), acc.Balance)
+
+    report, err := s.CheckLedger(ctx)
+    assert.Nil(t, err)
+    assert.True(t, report.Balanced())
+    assert.Equal(t, int64(2), report.Entries)
+}
+
+func TestMemoryStoreTransactions(t *testing.T){
+    s := NewMemoryStore()
+    from := newTestAccount(t, s, 111111, 100)
+    to := newTestAccount(t, s, 222222, 0)
+    for i := 1; i <= 5; i++ {
+        _, err := s.Transfer(ctx, from.ID, to.Number, int64(i))
+        assert.Nil(t, err)
+    }
+
+    // One deposit and five transfers, two at a time
+    q := &TransactionQuery{Limit: 2}
+    page, err := s.GetTransactions(ctx, from.ID, q)
+    assert.Nil(t, err)
+    assert.Len(t, page.Transactions, 2)
+    assert.Equal(t, int64(5), page.Transactions[0].Amount)
+    assert.Equal(t, DirectionDebit, page.Transactions[0].Direction)
+    assert.Equal(t, to.Number, *page.Transactions[0].Counterparty)
+
+    seen := len(page.Transactions)
+    for page.NextCursor != "" {
+        q.After, err = decodeCursor(page.NextCursor)
+        assert.Nil(t, err)
+        page, err = s.GetTransactions(ctx, from.ID, q)
+        assert.Nil(t, err)
+        seen += len(page.Transactions)
+    }
+    assert.Equal(t, 6, seen)
+
+    page, err = s.GetTransactions(ctx, from.ID, &TransactionQuery{Limit: 10, Direction: DirectionCredit})
+    assert.Nil(t, err)
+    assert.Len(t, page.Transactions, 1)
+    assert.Equal(t, EntryDeposit, page.Transactions[0].Kind)
+    assert.Nil(t, page.Transactions[0].Counterparty)
+
+    page, err = s.GetTransactions(ctx, to.ID, &TransactionQuery{Limit: 10, MinAmount: 2, MaxAmount: 4})
+    assert.Nil(t, err)
+    assert.Len(t, page.Transactions, 3)
+}
+
+func TestMemoryStoreIdempotency(t *testing.T){
+    s := NewMemoryStore()
+    rec := &IdempotencyRecord{Key: "k", Fingerprint: "f", CreatedAt: time.Now().UTC()}
+
+    existing, err := s.ReserveIdempotencyKey(ctx, rec)
+    assert.Nil(t, err)
+    assert.Nil(t, existing)
+
+    existing, _ = s.ReserveIdempotencyKey(ctx, rec)
+    assert.False(t, existing.Completed())
+
+    assert.Nil(t, s.CompleteIdempotencyKey(ctx, "k", 200, []byte("{}")))
+    existing, _ = s.ReserveIdempotencyKey(ctx, rec)
+    assert.Equal(t, 200, existing.StatusCode)
+    assert.Equal(t, []byte("{}"), existing.Body)
+
+    // Expired keys can be claimed again
+    later := *rec
+    later.CreatedAt = rec.CreatedAt.Add(idempotencyKeyTTL + time.Minute)
+    existing, _ = s.ReserveIdempotencyKey(ctx, &later)
+    assert.Nil(t, existing)
+}
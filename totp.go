@@ -0,0 +1,383 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// -- TWO-FACTOR AUTHENTICATION
+// Accounts can opt into time based one-time passwords (TOTP, RFC 6238) as a
+// second factor. Enrolling hands out a secret (and an otpauth:// URI that
+// authenticator apps read from a QR code), which only becomes active once
+// the first code generated from it has been confirmed. Confirming also hands
+// out recovery codes for when the phone is gone, they are stored hashed and
+// work once each.
+//
+// With TOTP enabled, POST /login no longer starts a session. It answers with
+// a short lived challenge token instead, which has to be completed at
+// POST /login/totp with a code (or a recovery code). Challenges only allow a
+// few attempts, otherwise 6 digits would not take long to guess.
+//
+// The TOTP secret itself has to be stored as it is, the server needs it to
+// compute the codes.
+
+const (
+    totpIssuer = "go-bank"
+    totpPeriod = 30 * time.Second
+    totpDigits = 6
+    // Codes from one period before and after are accepted as well, phones
+    // and servers are never quite in sync.
+    totpSkew = 1
+
+    recoveryCodeCount = 10
+
+    loginChallengeTTL         = 5 * time.Minute
+    maxLoginChallengeAttempts = 5
+)
+
+var (
+    ErrTOTPAlreadyEnabled    = NewAPIError(http.StatusConflict, "totp_already_enabled", "two-factor authentication is already enabled")
+    ErrTOTPNotEnrolled       = NewAPIError(http.StatusNotFound, "totp_not_enrolled", "two-factor authentication has not been set up")
+    ErrInvalidTOTPCode       = NewAPIError(http.StatusUnauthorized, "invalid_totp_code", "invalid two-factor authentication code")
+    ErrInvalidLoginChallenge = NewAPIError(http.StatusUnauthorized, "invalid_login_challenge",
+        "login challenge is invalid or has expired, log in again")
+)
+
+type TOTP struct {
+    AccountID   int
+    Secret      string
+    CreatedAt   time.Time
+    ConfirmedAt *time.Time
+    // The last time step a code was accepted for. Every code works only
+    // once, so a code that was seen over someone's shoulder is worthless.
+    LastStep int64
+}
+
+func (t *TOTP) Enabled() bool {
+    return t.ConfirmedAt != nil
+}
+
+type LoginChallenge struct {
+    TokenHash string
+    AccountID int
+    CreatedAt time.Time
+    ExpiresAt time.Time
+    Attempts  int
+}
+
+// The rules for accepting a login challenge, PostgresStore has them in the
+// WHERE of its UPDATE. Every use counts as an attempt, successful or not.
+func checkLoginChallenge(c *LoginChallenge, now time.Time) error {
+    if !now.Before(c.ExpiresAt) || c.Attempts >= maxLoginChallengeAttempts {
+        return ErrInvalidLoginChallenge
+    }
+    return nil
+}
+
+func newTOTPSecret() (string, error) {
+    b := make([]byte, 20)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// The URI that goes into the QR code, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpProvisioningURI(secret string, number int64) string {
+    label := url.PathEscape(totpIssuer + ":" + strconv.FormatInt(number, 10))
+    q := url.Values{}
+    q.Set("secret", secret)
+    q.Set("issuer", totpIssuer)
+    q.Set("algorithm", "SHA1")
+    q.Set("digits", strconv.Itoa(totpDigits))
+    q.Set("period", strconv.Itoa(int(totpPeriod.Seconds())))
+    return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func totpStep(t time.Time) int64 {
+    return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// The HOTP value (RFC 4226) for one time step
+func totpCode(secret string, step int64) (string, error) {
+    key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+    if err != nil {
+        return "", err
+    }
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    mod := uint32(1)
+    for i := 0; i < totpDigits; i++ {
+        mod *= 10
+    }
+    return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// Finding the time step that a code belongs to. Steps that have already been
+// used are skipped, the caller has to record the returned step with the
+// store (UseTOTPStep) which makes sure that it cannot be used twice.
+func verifyTOTP(t *TOTP, code string, now time.Time) (int64, bool) {
+    if len(code) != totpDigits {
+        return 0, false
+    }
+    current := totpStep(now)
+    for step := current - totpSkew; step <= current+totpSkew; step++ {
+        if step <= t.LastStep {
+            continue
+        }
+        want, err := totpCode(t.Secret, step)
+        if err != nil {
+            return 0, false
+        }
+        if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+// Recovery codes look like "abcd-efgh-ijkl-mnop". Dashes, spaces and case do
+// not matter when they are typed back in.
+func newRecoveryCodes() (plain []string, hashes []string, err error) {
+    enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+    for i := 0; i < recoveryCodeCount; i++ {
+        b := make([]byte, 10)
+        if _, err := rand.Read(b); err != nil {
+            return nil, nil, err
+        }
+        code := strings.ToLower(enc.EncodeToString(b))
+        plain = append(plain, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+        hashes = append(hashes, hashRecoveryCode(code))
+    }
+    return plain, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+    code = strings.ToLower(code)
+    code = strings.NewReplacer("-", "", " ", "").Replace(code)
+    return hashToken(code)
+}
+
+// Checking a second factor for an account with TOTP enabled. Anything that
+// is not a 6 digit code is treated as a recovery code.
+func (s *APIServer) verifySecondFactor(ctx context.Context, t *TOTP, code string, now time.Time) error {
+    code = strings.TrimSpace(code)
+    if len(code) == totpDigits {
+        step, ok := verifyTOTP(t, code, now)
+        if !ok {
+            return ErrInvalidTOTPCode
+        }
+        return s.store.UseTOTPStep(ctx, t.AccountID, step)
+    }
+    return s.store.UseRecoveryCode(ctx, t.AccountID, hashRecoveryCode(code), now)
+}
+
+// Called by handleLogin once the password has been checked. Accounts without
+// (confirmed) TOTP get their session right away.
+func (s *APIServer) loginResponse(ctx context.Context, acc *Account) (any, error) {
+    t, err := s.store.GetTOTP(ctx, acc.ID)
+    if err == nil && t.Enabled() {
+        return s.startLoginChallenge(ctx, acc)
+    }
+    if err != nil && !errors.Is(err, ErrTOTPNotEnrolled) {
+        return nil, err
+    }
+    if err := s.clearLoginFailures(ctx, acc.Number); err != nil {
+        return nil, err
+    }
+    return s.startSession(ctx, acc)
+}
+
+func (s *APIServer) startLoginChallenge(ctx context.Context, acc *Account) (*LoginChallengeResponse, error) {
+    now := time.Now().UTC()
+    plain, err := randomToken(32)
+    if err != nil {
+        return nil, err
+    }
+    challenge := &LoginChallenge{
+        TokenHash: hashToken(plain),
+        AccountID: acc.ID,
+        CreatedAt: now,
+        ExpiresAt: now.Add(loginChallengeTTL),
+    }
+    if err := s.store.CreateLoginChallenge(ctx, challenge); err != nil {
+        return nil, err
+    }
+    return &LoginChallengeResponse{
+        MFARequired: true,
+        ChallengeToken: plain,
+        ExpiresAt: challenge.ExpiresAt,
+    }, nil
+}
+
+// POST /login/totp
+// Completing a login challenge with a TOTP or recovery code
+func (s *APIServer) handleLoginTOTP(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    if r.Method != "POST" {
+        return errMethodNotAllowed(r.Method)
+    }
+    req := new(LoginTOTPRequest)
+    if err := decodeRequest(w, r, req); err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    challenge, err := s.store.UseLoginChallenge(ctx, hashToken(req.ChallengeToken), now)
+    if err != nil {
+        return err
+    }
+    t, err := s.store.GetTOTP(ctx, challenge.AccountID)
+    if errors.Is(err, ErrTOTPNotEnrolled) || (err == nil && !t.Enabled()) {
+        // Turned off in the meantime, the password has been checked already
+        // but the challenge is not worth anything anymore.
+        return ErrInvalidLoginChallenge
+    }
+    if err != nil {
+        return err
+    }
+    acc, err := s.store.GetAccountByID(ctx, challenge.AccountID)
+    if err != nil {
+        return err
+    }
+    // Wrong codes count towards the lockout just like wrong passwords
+    if err := s.checkLoginLockout(w, r, acc.Number); err != nil {
+        return err
+    }
+    err = s.verifySecondFactor(ctx, t, req.Code, now)
+    if errors.Is(err, ErrInvalidTOTPCode) {
+        s.audit(r, auditEvent{Action: AuditLoginFailed, Target: acc.Number, After: map[string]string{"factor": "totp"}})
+        s.metrics.loginFailed("totp")
+        if err := s.recordLoginFailure(r, acc.Number); err != nil {
+            return err
+        }
+        return ErrInvalidTOTPCode
+    }
+    if err != nil {
+        return err
+    }
+    if err := s.store.DeleteLoginChallenge(ctx, challenge.TokenHash); err != nil {
+        return err
+    }
+    if err := s.clearLoginFailures(ctx, acc.Number); err != nil {
+        return err
+    }
+
+    resp, err := s.startSession(ctx, acc)
+    if err != nil {
+        return err
+    }
+    s.audit(r, auditEvent{Action: AuditLoginSucceeded, Actor: acc, Target: acc.Number, After: map[string]string{"factor": "totp"}})
+    return WriteJSON(w, http.StatusOK, resp)
+}
+
+// POST /totp/enroll
+// Starting (or restarting) the TOTP setup of the logged in account. Nothing
+// changes for the login until the setup has been confirmed.
+func (s *APIServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    account, ok := authAccount(r)
+    if !ok {
+        return ErrNotAuthenticated
+    }
+    secret, err := newTOTPSecret()
+    if err != nil {
+        return err
+    }
+    t := &TOTP{
+        AccountID: account.ID,
+        Secret: secret,
+        CreatedAt: time.Now().UTC(),
+    }
+    if err := s.store.SaveTOTP(ctx, t); err != nil {
+        return err
+    }
+    return WriteJSON(w, http.StatusOK, &TOTPEnrollResponse{
+        Secret: secret,
+        ProvisioningURI: totpProvisioningURI(secret, account.Number),
+    })
+}
+
+// POST /totp/confirm
+// Proving that the authenticator app has been set up correctly, which turns
+// TOTP on. The recovery codes are only ever shown in this response.
+func (s *APIServer) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    account, ok := authAccount(r)
+    if !ok {
+        return ErrNotAuthenticated
+    }
+    req := new(TOTPCodeRequest)
+    if err := decodeRequest(w, r, req); err != nil {
+        return err
+    }
+    t, err := s.store.GetTOTP(ctx, account.ID)
+    if err != nil {
+        return err
+    }
+    if t.Enabled() {
+        return ErrTOTPAlreadyEnabled
+    }
+    now := time.Now().UTC()
+    step, ok := verifyTOTP(t, strings.TrimSpace(req.Code), now)
+    if !ok {
+        return ErrInvalidTOTPCode
+    }
+    plain, hashes, err := newRecoveryCodes()
+    if err != nil {
+        return err
+    }
+    if err := s.store.ConfirmTOTP(ctx, account.ID, step, hashes, now); err != nil {
+        return err
+    }
+    s.audit(r, auditEvent{Action: AuditTOTPEnabled, Target: account.Number})
+    return WriteJSON(w, http.StatusOK, &RecoveryCodesResponse{RecoveryCodes: plain})
+}
+
+// POST /totp/disable
+// Turning TOTP off again, which needs a current code (or a recovery code) so
+// that a stolen access token alone is not enough.
+func (s *APIServer) handleDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+    ctx := r.Context()
+    account, ok := authAccount(r)
+    if !ok {
+        return ErrNotAuthenticated
+    }
+    req := new(TOTPCodeRequest)
+    if err := decodeRequest(w, r, req); err != nil {
+        return err
+    }
+    t, err := s.store.GetTOTP(ctx, account.ID)
+    if err != nil {
+        return err
+    }
+    if t.Enabled() {
+        if err := s.verifySecondFactor(ctx, t, req.Code, time.Now().UTC()); err != nil {
+            return err
+        }
+    }
+    if err := s.store.DeleteTOTP(ctx, account.ID); err != nil {
+        return err
+    }
+    s.audit(r, auditEvent{Action: AuditTOTPDisabled, Target: account.Number})
+    return WriteJSON(w, http.StatusOK, map[string]bool{"totp_enabled": false})
+}
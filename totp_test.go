@@ -0,0 +1,123 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T){
+    // The SHA-1 test vectors of RFC 6238, cut down to 6 digits
+    secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+    for unix, want := range map[int64]string{
+        59: "287082",
+        1111111109: "081804",
+        1234567890: "005924",
+        2000000000: "279037",
+    } {
+        code, err := totpCode(secret, totpStep(time.Unix(unix, 0)))
+        assert.Nil(t, err)
+        assert.Equal(t, want, code)
+    }
+
+    now := time.Unix(1234567890, 0)
+    tp := &TOTP{Secret: secret}
+    step, ok := verifyTOTP(tp, "005924", now)
+    assert.True(t, ok)
+    // One period of clock drift is fine, two are not
+    _, ok = verifyTOTP(tp, "005924", now.Add(totpPeriod))
+    assert.True(t, ok)
+    _, ok = verifyTOTP(tp, "005924", now.Add(2*totpPeriod))
+    assert.False(t, ok)
+    // and a code is never accepted twice
+    tp.LastStep = step
+    _, ok = verifyTOTP(tp, "005924", now)
+    assert.False(t, ok)
+}
+
+func TestTOTPLogin(t *testing.T){
+    server, store, router := newTestServer()
+    acc, err := NewAccount("a", "b", "hello123")
+    assert.Nil(t, err)
+    assert.Nil(t, store.CreateAccount(ctx, acc))
+    login := &LoginRequest{Number: acc.Number, Password: "hello123"}
+    token := loginAs(t, server, acc).Token
+
+    enroll := new(TOTPEnrollResponse)
+    rr := doRequest(t, router, "POST", "/totp/enroll", token, nil, enroll)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Contains(t, enroll.ProvisioningURI, "secret="+enroll.Secret)
+
+    // Not confirmed yet, so logging in still works with the password alone
+    session := new(LoginResponse)
+    rr = doRequest(t, router, "POST", "/login", "", login, session)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.NotEmpty(t, session.Token)
+
+    now := time.Now()
+    code, _ := totpCode(enroll.Secret, totpStep(now))
+    rr = doRequest(t, router, "POST", "/totp/confirm", token, TOTPCodeRequest{"000000"}, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    recovery := new(RecoveryCodesResponse)
+    rr = doRequest(t, router, "POST", "/totp/confirm", token, TOTPCodeRequest{code}, recovery)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Len(t, recovery.RecoveryCodes, recoveryCodeCount)
+    rr = doRequest(t, router, "POST", "/totp/enroll", token, nil, nil)
+    assert.Equal(t, http.StatusConflict, rr.Code)
+
+    // Now the password only gets a challenge
+    challenge := new(LoginChallengeResponse)
+    rr = doRequest(t, router, "POST", "/login", "", login, challenge)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.True(t, challenge.MFARequired)
+
+    // The code that confirmed the setup has been used up
+    rr = doRequest(t, router, "POST", "/login/totp", "", LoginTOTPRequest{challenge.ChallengeToken, code}, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    next, _ := totpCode(enroll.Secret, totpStep(now)+1)
+    session = new(LoginResponse)
+    rr = doRequest(t, router, "POST", "/login/totp", "", LoginTOTPRequest{challenge.ChallengeToken, next}, session)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    rr = doRequest(t, router, "GET", "/account/1", session.Token, nil, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+
+    // A completed challenge cannot be used again
+    rr = doRequest(t, router, "POST", "/login/totp", "", LoginTOTPRequest{challenge.ChallengeToken, recovery.RecoveryCodes[0]}, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+    // Recovery codes work once each, in any case and without dashes
+    challenge = new(LoginChallengeResponse)
+    doRequest(t, router, "POST", "/login", "", login, challenge)
+    typed := "  " + recovery.RecoveryCodes[0][:4] + " " + recovery.RecoveryCodes[0][5:]
+    rr = doRequest(t, router, "POST", "/login/totp", "", LoginTOTPRequest{challenge.ChallengeToken, typed}, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    challenge = new(LoginChallengeResponse)
+    doRequest(t, router, "POST", "/login", "", login, challenge)
+    rr = doRequest(t, router, "POST", "/login/totp", "", LoginTOTPRequest{challenge.ChallengeToken, recovery.RecoveryCodes[0]}, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+    // Guessing runs out of attempts, even the right code does not help then
+    for i := 1; i < maxLoginChallengeAttempts; i++ {
+        doRequest(t, router, "POST", "/login/totp", "", LoginTOTPRequest{challenge.ChallengeToken, "000000"}, nil)
+    }
+    apiErr := new(APIError)
+    rr = doRequest(t, router, "POST", "/login/totp", "", LoginTOTPRequest{challenge.ChallengeToken, recovery.RecoveryCodes[1]}, apiErr)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    assert.Equal(t, "invalid_login_challenge", apiErr.Code)
+
+    // Turning it off needs a code as well
+    rr = doRequest(t, router, "POST", "/totp/disable", token, TOTPCodeRequest{"000000"}, nil)
+    assert.Equal(t, http.StatusUnauthorized, rr.Code)
+    rr = doRequest(t, router, "POST", "/totp/disable", token, TOTPCodeRequest{recovery.RecoveryCodes[1]}, nil)
+    assert.Equal(t, http.StatusOK, rr.Code)
+
+    // All those wrong codes have locked the account in the meantime
+    rr = doRequest(t, router, "POST", "/login", "", login, nil)
+    assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+    assert.Nil(t, server.clearLoginFailures(ctx, acc.Number))
+    session = new(LoginResponse)
+    rr = doRequest(t, router, "POST", "/login", "", login, session)
+    assert.NotEmpty(t, session.Token)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+    "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// -- TRACING
+// Requests are traced with OpenTelemetry: one server span per request, named
+// after the route (POST /transfer), a span for withJWT (with jwt.verify
+// inside it) and one for every PostgresStore operation. A traceparent header
+// sent by the caller (W3C trace context) is picked up, so our spans end up in
+// the trace of whoever called us.
+//
+// Where the spans go is up to tracing.exporter:
+//
+//     none    nothing is recorded (the default), incoming trace context is
+//             still passed on to the logs
+//     stdout  JSON on stdout, for looking at traces without any backend
+//     file    the same JSON appended to tracing.file
+//     otlp    OTLP over HTTP, configured with the usual OTEL_EXPORTER_OTLP_*
+//             variables (http://localhost:4318 by default)
+
+const (
+    TraceExporterNone   = "none"
+    TraceExporterStdout = "stdout"
+    TraceExporterFile   = "file"
+    TraceExporterOTLP   = "otlp"
+)
+
+const tracerName = "github.com/IAmRiteshKoushik/go-bank"
+
+type TracingConfig struct {
+    Exporter string `json:"exporter" yaml:"exporter"`
+    File     string `json:"file" yaml:"file"`
+    // Share of the traces that start here which are kept, between 0 and 1.
+    // Traces that the caller started follow the caller's decision.
+    SampleRatio float64 `json:"sample_ratio" yaml:"sample_ratio"`
+}
+
+// Always asking the global provider, so that whatever SetupTracing (or a
+// test) installed is used even by code that started before.
+func tracer() trace.Tracer {
+    return otel.Tracer(tracerName)
+}
+
+// Installing the global tracer provider and propagator. The returned function
+// flushes the spans that are still buffered and has to be called on exit.
+func SetupTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+    otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+        propagation.TraceContext{},
+        propagation.Baggage{},
+    ))
+    if cfg.Exporter == TraceExporterNone {
+        return func(context.Context) error { return nil }, nil
+    }
+
+    var exporter sdktrace.SpanExporter
+    var closeFile func() error
+    var err error
+    switch cfg.Exporter {
+    case TraceExporterStdout:
+        exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+    case TraceExporterFile:
+        f, openErr := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+        if openErr != nil {
+            return nil, fmt.Errorf("opening trace file: %w", openErr)
+        }
+        closeFile = f.Close
+        exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+    case TraceExporterOTLP:
+        exporter, err = otlptracehttp.New(ctx)
+    default:
+        err = fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    // OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over the defaults
+    res, err := resource.New(ctx,
+        resource.WithAttributes(semconv.ServiceName("go-bank")),
+        resource.WithFromEnv(),
+        resource.WithTelemetrySDK(),
+    )
+    if err != nil {
+        return nil, err
+    }
+    provider := sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithResource(res),
+        sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+    )
+    otel.SetTracerProvider(provider)
+
+    return func(ctx context.Context) error {
+        err := provider.Shutdown(ctx)
+        if closeFile != nil {
+            err = errors.Join(err, closeFile())
+        }
+        return err
+    }, nil
+}
+
+// The server span of a request. It starts out named after the method only,
+// noteRoute renames it once the router has found the route.
+func withTracing(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+        ctx, span := tracer().Start(ctx, r.Method,
+            trace.WithSpanKind(trace.SpanKindServer),
+            trace.WithAttributes(
+                semconv.HTTPRequestMethodKey.String(r.Method),
+                semconv.URLPath(r.URL.Path),
+            ))
+        defer span.End()
+
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r.WithContext(ctx))
+
+        status := rec.Status()
+        span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+        // Client errors are the client's problem, not a failed span
+        if status >= http.StatusInternalServerError {
+            span.SetStatus(codes.Error, http.StatusText(status))
+        }
+    })
+}
+
+// Ending a span with the outcome of whatever it covered. Errors that are meant
+// for the client (a wrong token, insufficient funds) are not failures of ours
+// and only leave their code behind.
+func endSpan(span trace.Span, err error) {
+    if err != nil {
+        apiErr := toAPIError(err)
+        span.SetAttributes(attribute.String("error.code", apiErr.Code))
+        if apiErr.Status >= http.StatusInternalServerError {
+            span.RecordError(err)
+            span.SetStatus(codes.Error, err.Error())
+        }
+    }
+    span.End()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/codes"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Recording every span into memory for the rest of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+    recorder := tracetest.NewSpanRecorder()
+    provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+    previous := otel.GetTracerProvider()
+    otel.SetTracerProvider(provider)
+    t.Cleanup(func() {
+        otel.SetTracerProvider(previous)
+    })
+    return recorder
+}
+
+func spanNamed(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+    for _, span := range spans {
+        if span.Name() == name {
+            return span
+        }
+    }
+    return nil
+}
+
+func TestTracing(t *testing.T){
+    _, err := SetupTracing(context.Background(), TracingConfig{Exporter: TraceExporterNone})
+    assert.Nil(t, err)
+    recorder := recordSpans(t)
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    newTestAccount(t, store, 222222, 0)
+    token := loginAs(t, server, from).Token
+
+    // The caller's trace is continued
+    traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+    req := httptest.NewRequest("POST", "/transfer", bytes.NewBufferString(`{"to_account": 222222, "amount": 40}`))
+    req.Header.Set("x-jwt-token", token)
+    req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+    rr := httptest.NewRecorder()
+    router.ServeHTTP(rr, req)
+    assert.Equal(t, http.StatusOK, rr.Code)
+
+    spans := recorder.Ended()
+    root := spanNamed(spans, "POST /transfer")
+    if assert.NotNil(t, root) {
+        assert.Equal(t, traceID, root.SpanContext().TraceID().String())
+        assert.Equal(t, "00f067aa0ba902b7", root.Parent().SpanID().String())
+        assert.True(t, root.Parent().IsRemote())
+    }
+    auth := spanNamed(spans, "withJWT")
+    verify := spanNamed(spans, "jwt.verify")
+    if assert.NotNil(t, auth) && assert.NotNil(t, verify) && root != nil {
+        assert.Equal(t, root.SpanContext().SpanID(), auth.Parent().SpanID())
+        assert.Equal(t, auth.SpanContext().SpanID(), verify.Parent().SpanID())
+    }
+
+    // A failed request is a failed span, a rejected token is not
+    server, _, _ = newTestServer()
+    server.store = slowStore{NewMemoryStore()}
+    acc := newTestAccount(t, server.store, 123456, 0)
+    token = loginAs(t, server, acc).Token
+    doRequest(t, server.Router(), "GET", "/account/1/transactions", token, nil, nil)
+    doRequest(t, server.Router(), "GET", "/account/1/transactions", "broken", nil, nil)
+    roots := []sdktrace.ReadOnlySpan{}
+    for _, span := range recorder.Ended() {
+        if span.Name() == "GET /account/{id}/transactions" {
+            roots = append(roots, span)
+        }
+    }
+    if assert.Len(t, roots, 2) {
+        assert.Equal(t, codes.Error, roots[0].Status().Code)
+        assert.Equal(t, codes.Unset, roots[1].Status().Code)
+    }
+}
+
+func TestSetupTracingFile(t *testing.T){
+    previous := otel.GetTracerProvider()
+    t.Cleanup(func() {
+        otel.SetTracerProvider(previous)
+    })
+    path := filepath.Join(t.TempDir(), "traces.jsonl")
+    shutdown, err := SetupTracing(context.Background(), TracingConfig{Exporter: TraceExporterFile, File: path, SampleRatio: 1})
+    assert.Nil(t, err)
+
+    _, _, router := newTestServer()
+    doRequest(t, router, "GET", "/healthz", "", nil, nil)
+    assert.Nil(t, shutdown(context.Background()))
+
+    data, err := os.ReadFile(path)
+    assert.Nil(t, err)
+    assert.Contains(t, string(data), `"Name":"GET /healthz"`)
+}
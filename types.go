@@ -3,13 +3,46 @@ package main
 import (
     "math/rand/v2"
     "time"
-
-    "golang.org/x/crypto/bcrypt"
 )
 
 type LoginResponse struct {
     Number int64 `json:"number"`
     Token  string `json:"token"`
+    // When the access token (Token) stops working. The refresh token can be
+    // traded for a new pair at POST /token/refresh until the session ends.
+    ExpiresAt    time.Time `json:"expires_at"`
+    RefreshToken string    `json:"refresh_token"`
+}
+
+// What POST /login answers with for accounts that have TOTP enabled, the
+// challenge token has to be completed at POST /login/totp.
+type LoginChallengeResponse struct {
+    MFARequired    bool      `json:"mfa_required"`
+    ChallengeToken string    `json:"challenge_token"`
+    ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// Code is either the current TOTP code or one of the recovery codes
+type LoginTOTPRequest struct {
+    ChallengeToken string `json:"challenge_token"`
+    Code           string `json:"code"`
+}
+
+type TOTPCodeRequest struct {
+    Code string `json:"code"`
+}
+
+type TOTPEnrollResponse struct {
+    Secret          string `json:"secret"`
+    ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type RecoveryCodesResponse struct {
+    RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type RefreshRequest struct {
+    RefreshToken string `json:"refresh_token"`
 }
 
 type LoginRequest struct {
@@ -27,6 +60,7 @@ type Account struct {
     EncryptedPassword string `json:"-"`
     Balance   int64     `json:"balance"`
     CreatedAt time.Time `json:"created_at"`
+    Role      string    `json:"role"`
 }
 
 type CreateAccountRequest struct {
@@ -38,26 +72,89 @@ type CreateAccountRequest struct {
     Password string `json:"password"`
 }
 
+// Used by tellers for POST /account/{id}/deposit and /withdraw
+type CashRequest struct {
+    Amount int64 `json:"amount"`
+}
+
+// Used by customers for PUT /account/{id}/password
+type ChangePasswordRequest struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+// Used for POST /password/reset/request, the token goes out through the
+// notifier
+type PasswordResetRequest struct {
+    Number int64 `json:"number"`
+}
+
+type ResetPasswordRequest struct {
+    Token       string `json:"token"`
+    NewPassword string `json:"new_password"`
+}
+
+// Used by admins for PUT /account/{id}/role
+type UpdateRoleRequest struct {
+    Role string `json:"role"`
+}
+
 type TransferRequest struct {
     ToAccount   int     `json:"to_account"`
     Amount      int     `json:"amount"`
 }
 
+// Transfer is the record of a completed money movement between two accounts.
+// The balances are the ones that both accounts were left with right after the
+// transfer got committed, which is handy for clients that want to update
+// their UI without having to fetch the account again.
+type Transfer struct {
+    ID          int64     `json:"id"`
+    FromAccount int64     `json:"from_account"`
+    ToAccount   int64     `json:"to_account"`
+    Amount      int64     `json:"amount"`
+    FromBalance int64     `json:"from_balance"`
+    ToBalance   int64     `json:"to_balance"`
+    CreatedAt   time.Time `json:"created_at"`
+    PostedAt    time.Time `json:"posted_at"`
+    Hash        string    `json:"hash,omitempty"`
+}
+
 func NewAccount(firstName, lastName, password string) (*Account, error) {
-    encpw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    encpw, err := hashPassword(password)
     if err != nil {
         return nil, err
     }
     return &Account{
         FirstName: firstName,
         LastName: lastName,
-        Number: int64(rand.IntN(1000000)),
-        EncryptedPassword: string(encpw),
+        Number: newAccountNumber(),
+        EncryptedPassword: encpw,
         Balance: 0,
         CreatedAt: time.Now().UTC(),
+        Role: RoleCustomer,
     }, nil
 }
 
+// Account numbers are picked at random, the store rejects duplicates with
+// ErrAccountNumberTaken in which case a new one has to be drawn. Zero is not
+// an account number, requests that carry one are rejected (see validation.go).
+func newAccountNumber() int64 {
+    return 1 + int64(rand.IntN(maxAccountNumber))
+}
+
+// See hasher.go for the algorithms
+func hashPassword(pw string) (string, error) {
+    return passwordHashing.Hash(pw)
+}
+
 func (a *Account) ValidPassword(pw string) (bool) {
-    return bcrypt.CompareHashAndPassword([]byte(a.EncryptedPassword), []byte(pw)) == nil
+    ok, _ := a.CheckPassword(pw)
+    return ok
+}
+
+// Like ValidPassword, but also telling whether the stored hash is due for an
+// upgrade to the current algorithm and parameters.
+func (a *Account) CheckPassword(pw string) (ok bool, rehash bool) {
+    return passwordHashing.Verify(a.EncryptedPassword, pw)
 }
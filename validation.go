@@ -0,0 +1,282 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "reflect"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// -- REQUEST VALIDATION
+// Request bodies are decoded strictly (decodeJSON): fields that the request
+// type does not have, anything after the JSON object and bodies larger than
+// maxBodyBytes are rejected instead of silently ignored. The decoded request
+// is then checked against the rules of its type (the validate methods below)
+// and every field that breaks a rule is listed in a single 422:
+//
+//     {"code":"validation_failed","error":"request is invalid",
+//      "details":[{"field":"first_name","in":"body","message":"must not be empty"},
+//                 {"field":"password","in":"body","message":"password must be at least 8 characters long"}]}
+//
+// withValidation (see openapi.go) has already made sure that the body has the
+// right shape by then. The rules are described in openapi.yaml as well, but
+// only checked here, so that all of them are reported in one go.
+
+const (
+    // Every request body of the API is a handful of fields
+    maxBodyBytes = 64 << 10
+
+    maxNameLength = 50
+    // Account numbers have six digits at most, see newAccountNumber
+    maxAccountNumber = 999999
+    // The most that a single transfer, deposit or withdrawal can move
+    maxAmount = 100_000_000
+    // Refresh tokens, reset tokens, challenge tokens and TOTP codes are far
+    // shorter, anything longer is not worth hashing and looking up
+    maxTokenLength = 256
+)
+
+var (
+    ErrValidationFailed = NewAPIError(http.StatusUnprocessableEntity, "validation_failed", "request is invalid")
+    ErrBodyTooLarge     = NewAPIError(http.StatusRequestEntityTooLarge, "body_too_large",
+        "request body is larger than %d bytes", maxBodyBytes)
+)
+
+// One entry in the details of ErrValidationFailed. Field is the name of the
+// parameter or the path to the field in the body (to_account, items.0.amount),
+// "body" for the body as a whole. In is path, query, header or body.
+type FieldError struct {
+    Field   string `json:"field"`
+    In      string `json:"in"`
+    Message string `json:"message"`
+}
+
+const fieldInBody = "body"
+
+// Collecting what is wrong with a request body
+type validator struct {
+    fields []FieldError
+}
+
+func (v *validator) add(field, format string, args ...any) {
+    v.fields = append(v.fields, FieldError{Field: field, In: fieldInBody, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) check(ok bool, field, format string, args ...any) {
+    if !ok {
+        v.add(field, format, args...)
+    }
+}
+
+// Nil if nothing was wrong
+func (v *validator) err() error {
+    if len(v.fields) == 0 {
+        return nil
+    }
+    return ErrValidationFailed.WithDetails(v.fields)
+}
+
+// Tokens and codes have to be there, their actual value is checked by
+// whoever looks them up.
+func (v *validator) token(field, value string) {
+    switch {
+    case value == "":
+        v.add(field, "must not be empty")
+    case len(value) > maxTokenLength:
+        v.add(field, "must be at most %d characters long", maxTokenLength)
+    }
+}
+
+func (v *validator) name(field, value string) {
+    switch {
+    case value == "":
+        v.add(field, "must not be empty")
+    case utf8.RuneCountInString(value) > maxNameLength:
+        v.add(field, "must be at most %d characters long", maxNameLength)
+    case !validName(value):
+        v.add(field, "must start with a letter and may only contain letters, spaces, hyphens, apostrophes and dots")
+    }
+}
+
+// Names end up on statements. Letters of any script, and the few characters
+// that names like "Mary-Jane O'Brien Jr." need in between.
+func validName(name string) bool {
+    for i, r := range name {
+        switch {
+        case unicode.IsLetter(r):
+        case i == 0:
+            return false
+        case unicode.IsMark(r), strings.ContainsRune(" -'.", r):
+        default:
+            return false
+        }
+    }
+    return !strings.HasSuffix(name, " ")
+}
+
+func (v *validator) password(field, pw string) {
+    if err := checkNewPassword(pw); err != nil {
+        v.add(field, "%s", err)
+    }
+}
+
+func (v *validator) accountNumber(field string, number int64) {
+    v.check(number > 0 && number <= maxAccountNumber, field, "must be an account number between 1 and %d", maxAccountNumber)
+}
+
+func (v *validator) amount(field string, amount int64) {
+    v.check(amount > 0 && amount <= maxAmount, field, "must be between 1 and %d", maxAmount)
+}
+
+// -- RULES
+// One validate method for every request type in types.go
+
+type validatable interface {
+    validate(v *validator)
+}
+
+func (req *LoginRequest) validate(v *validator) {
+    v.accountNumber("number", req.Number)
+    v.check(req.Password != "", "password", "must not be empty")
+}
+
+func (req *LoginTOTPRequest) validate(v *validator) {
+    v.token("challenge_token", req.ChallengeToken)
+    v.token("code", req.Code)
+}
+
+func (req *TOTPCodeRequest) validate(v *validator) {
+    v.token("code", req.Code)
+}
+
+func (req *RefreshRequest) validate(v *validator) {
+    v.token("refresh_token", req.RefreshToken)
+}
+
+func (req *CreateAccountRequest) validate(v *validator) {
+    v.name("first_name", req.FirstName)
+    v.name("last_name", req.LastName)
+    v.password("password", req.Password)
+}
+
+func (req *CashRequest) validate(v *validator) {
+    v.amount("amount", req.Amount)
+}
+
+func (req *ChangePasswordRequest) validate(v *validator) {
+    v.check(req.CurrentPassword != "", "current_password", "must not be empty")
+    v.password("new_password", req.NewPassword)
+}
+
+func (req *PasswordResetRequest) validate(v *validator) {
+    v.accountNumber("number", req.Number)
+}
+
+func (req *ResetPasswordRequest) validate(v *validator) {
+    v.token("token", req.Token)
+    v.password("new_password", req.NewPassword)
+}
+
+func (req *UpdateRoleRequest) validate(v *validator) {
+    v.check(validRole(req.Role), "role", "must be one of %s, %s or %s", RoleCustomer, RoleTeller, RoleAdmin)
+}
+
+// Only the numbers, whether the destination exists is up to
+// checkDestination which needs the store.
+func (req *TransferRequest) validate(v *validator) {
+    v.accountNumber("to_account", int64(req.ToAccount))
+    v.amount("amount", int64(req.Amount))
+}
+
+// The money has to go to some other account that exists. The stores check
+// this again inside the transaction (the account can be deleted in between),
+// this is about reporting it together with everything else.
+func (s *APIServer) checkDestination(ctx context.Context, v *validator, from *Account, number int64) error {
+    if number == from.Number {
+        v.add("to_account", "cannot transfer money to your own account")
+        return nil
+    }
+    if number <= 0 || number > maxAccountNumber {
+        // Already reported by TransferRequest.validate
+        return nil
+    }
+    _, err := s.store.GetAccountByNumber(ctx, int(number))
+    if errors.Is(err, ErrAccountNotFound) {
+        v.add("to_account", "there is no account with this number")
+        return nil
+    }
+    return err
+}
+
+// -- DECODING
+
+// Decoding the body of a request and checking it against the rules of its
+// type, see the top of this file.
+func decodeRequest(w http.ResponseWriter, r *http.Request, req validatable) error {
+    if err := decodeJSON(w, r, req); err != nil {
+        return err
+    }
+    v := new(validator)
+    req.validate(v)
+    return v.err()
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(dst); err != nil {
+        return decodeError(err)
+    }
+    switch _, err := dec.Token(); {
+    case err == io.EOF:
+        return nil
+    case err != nil:
+        return decodeError(err)
+    default:
+        return ErrInvalidJSON.WithDetails("the body has to be a single JSON object")
+    }
+}
+
+// Syntax errors are left to toAPIError, the rest can point at a field
+func decodeError(err error) error {
+    var tooLarge *http.MaxBytesError
+    var typeErr *json.UnmarshalTypeError
+    switch {
+    case errors.As(err, &tooLarge):
+        return ErrBodyTooLarge
+    case errors.As(err, &typeErr) && typeErr.Field != "":
+        return ErrValidationFailed.WithDetails([]FieldError{{
+            Field: typeErr.Field,
+            In: fieldInBody,
+            Message: fmt.Sprintf("must be %s, not %s", jsonTypeName(typeErr.Type), typeErr.Value),
+        }})
+    case strings.HasPrefix(err.Error(), "json: unknown field "):
+        // encoding/json has no error type for this one
+        field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+        return ErrValidationFailed.WithDetails([]FieldError{{Field: field, In: fieldInBody, Message: "unknown field"}})
+    }
+    return err
+}
+
+func jsonTypeName(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return "an integer"
+    case reflect.Float32, reflect.Float64:
+        return "a number"
+    case reflect.String:
+        return "a string"
+    case reflect.Bool:
+        return "true or false"
+    case reflect.Slice, reflect.Array:
+        return "an array"
+    }
+    return "an object"
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+// The fields listed in a validation_failed response, in order
+func invalidFields(t *testing.T, rr *httptest.ResponseRecorder) []string {
+    var resp struct {
+        Code    string       `json:"code"`
+        Details []FieldError `json:"details"`
+    }
+    assert.Nil(t, json.NewDecoder(rr.Body).Decode(&resp))
+    assert.Equal(t, "validation_failed", resp.Code)
+    fields := []string{}
+    for _, f := range resp.Details {
+        fields = append(fields, f.Field)
+    }
+    return fields
+}
+
+func TestValidName(t *testing.T){
+    for _, name := range []string{"a", "Ritesh", "Mary-Jane", "O'Brien", "Jr.", "van der Berg", "José", "Zoë", "Ελένη", "李"} {
+        assert.True(t, validName(name), name)
+    }
+    for _, name := range []string{" Ann", "Ann ", "-Ann", "R2D2", "Ann!", "<script>", "Ann\n"} {
+        assert.False(t, validName(name), name)
+    }
+}
+
+func TestCheckNewPassword(t *testing.T){
+    for _, pw := range []string{"hello123", "brand-new-pw", "correct horse battery staple", "пароль-007"} {
+        assert.Nil(t, checkNewPassword(pw), pw)
+    }
+    for _, pw := range []string{"", "short1", "abcdefghij", "1234567890", strings.Repeat("a1", 65), "Password123"} {
+        assert.NotNil(t, checkNewPassword(pw), pw)
+    }
+}
+
+func TestRequestRules(t *testing.T){
+    for _, tc := range []struct {
+        req     validatable
+        invalid []string
+    }{
+        {&CreateAccountRequest{"Ann", "Lee", "hello123"}, nil},
+        {&CreateAccountRequest{}, []string{"first_name", "last_name", "password"}},
+        {&CreateAccountRequest{strings.Repeat("a", 51), "Lee", "hello123"}, []string{"first_name"}},
+        {&TransferRequest{ToAccount: 123456, Amount: 1}, nil},
+        {&TransferRequest{ToAccount: 0, Amount: -5}, []string{"to_account", "amount"}},
+        {&TransferRequest{ToAccount: 1000000, Amount: maxAmount + 1}, []string{"to_account", "amount"}},
+        {&CashRequest{Amount: 0}, []string{"amount"}},
+        {&LoginRequest{Number: 123456}, []string{"password"}},
+        {&ChangePasswordRequest{"", "short"}, []string{"current_password", "new_password"}},
+        {&ResetPasswordRequest{strings.Repeat("t", maxTokenLength+1), "hello123"}, []string{"token"}},
+        {&UpdateRoleRequest{"boss"}, []string{"role"}},
+        {&UpdateRoleRequest{RoleTeller}, nil},
+        {&RefreshRequest{}, []string{"refresh_token"}},
+        {&LoginTOTPRequest{}, []string{"challenge_token", "code"}},
+        {&PasswordResetRequest{-1}, []string{"number"}},
+    } {
+        v := new(validator)
+        tc.req.validate(v)
+        fields := []string{}
+        for _, f := range v.fields {
+            fields = append(fields, f.Field)
+        }
+        if tc.invalid == nil {
+            tc.invalid = []string{}
+        }
+        assert.Equal(t, tc.invalid, fields, "%#v", tc.req)
+    }
+}
+
+func TestDecodeJSON(t *testing.T){
+    decode := func(body string) error {
+        r := httptest.NewRequest("POST", "/transfer", strings.NewReader(body))
+        return decodeJSON(httptest.NewRecorder(), r, new(TransferRequest))
+    }
+    assert.Nil(t, decode(`{"to_account": 123456, "amount": 10}`))
+
+    var apiErr *APIError
+    assert.True(t, errors.As(decode(`{"to_account": 123456, "amount": 10, "from_account": 1}`), &apiErr))
+    assert.Equal(t, "validation_failed", apiErr.Code)
+    assert.Equal(t, []FieldError{{Field: "from_account", In: "body", Message: "unknown field"}}, apiErr.Details)
+
+    assert.True(t, errors.As(decode(`{"to_account": 123456, "amount": 1.5}`), &apiErr))
+    assert.Equal(t, "amount", apiErr.Details.([]FieldError)[0].Field)
+
+    assert.ErrorIs(t, decode(`{"amount": 10}{"amount": 20}`), ErrInvalidJSON)
+    assert.Equal(t, "invalid_json", toAPIError(decode(`{"amount": 10} trailing`)).Code)
+    assert.Equal(t, "invalid_json", toAPIError(decode(`{"amount": `)).Code)
+    assert.ErrorIs(t, decode(`{"to_account": "`+strings.Repeat("1", maxBodyBytes)+`"}`), ErrBodyTooLarge)
+}
+
+func TestTransferValidation(t *testing.T){
+    server, store, router := newTestServer()
+    from := newTestAccount(t, store, 111111, 100)
+    newTestAccount(t, store, 222222, 0)
+    token := loginAs(t, server, from).Token
+
+    // Everything that is wrong comes back at once
+    rr := doRequest(t, router, "POST", "/transfer", token, TransferRequest{ToAccount: 111111, Amount: -5}, nil)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    assert.Equal(t, []string{"amount", "to_account"}, invalidFields(t, rr))
+
+    rr = doRequest(t, router, "POST", "/transfer", token, TransferRequest{ToAccount: 333333, Amount: 10}, nil)
+    assert.Equal(t, []string{"to_account"}, invalidFields(t, rr))
+    rr = doRequest(t, router, "POST", "/transfer", token, map[string]any{"to_account": 222222, "amount": 10, "from_account": 222222}, nil)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    assert.Equal(t, []string{"from_account"}, invalidFields(t, rr))
+
+    // Nothing was moved by any of them
+    acc, _ := store.GetAccountByNumber(ctx, 111111)
+    assert.Equal(t, int64(100), acc.Balance)
+
+    req := httptest.NewRequest("POST", "/transfer", bytes.NewBufferString(`{"to_account": 222222, "amount": 10, "note": "`+strings.Repeat("x", maxBodyBytes)+`"}`))
+    req.Header.Set("x-jwt-token", token)
+    rr = httptest.NewRecorder()
+    router.ServeHTTP(rr, req)
+    assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestCreateAccountValidation(t *testing.T){
+    _, store, router := newTestServer()
+
+    rr := doRequest(t, router, "POST", "/account", "", CreateAccountRequest{"", "R2D2", "password1"}, nil)
+    assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+    assert.Equal(t, []string{"first_name", "last_name", "password"}, invalidFields(t, rr))
+    accounts, _ := store.GetAccounts(ctx)
+    assert.Empty(t, accounts)
+
+    acc := new(Account)
+    rr = doRequest(t, router, "POST", "/account", "", CreateAccountRequest{"Mary-Jane", "O'Brien", "brand-new-pw"}, acc)
+    assert.Equal(t, http.StatusOK, rr.Code)
+    assert.Equal(t, "Mary-Jane", acc.FirstName)
+    assert.True(t, acc.Number > 0 && acc.Number <= maxAccountNumber)
+}